@@ -0,0 +1,380 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+// Package admin serves a REST API over an RTimeWheel, so that services in any
+// language can schedule and manage callbacks.
+//
+//	POST   /tasks                         {"key", "execution_time", "task"}, add a task
+//	GET    /tasks?from=&to=&limit=        list the pending tasks due in a time range
+//	GET    /tasks/{key}                   get a task
+//	DELETE /tasks/{key}                   remove a pending task
+//	POST   /tasks/{key}/reschedule        {"execution_time"}, reschedule a pending task
+//	GET    /dead-letters?offset=&limit=   list the dead letters, most recent first
+//	GET    /dead-letters/{key}            get a dead letter
+//	POST   /dead-letters/{key}/replay     {"execution_time"}, replay a dead letter
+//	DELETE /dead-letters/{key}            purge a dead letter
+//	GET    /healthz                       check Redis, never authenticated
+//
+// Times are RFC 3339, errors are returned as {"error": "..."}. Only http tasks
+// are accepted unless WithTaskTypes allows others.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Nicknamezz00/timewheel"
+)
+
+// HeaderAPIKey carries the API key, which may also be sent as a bearer token.
+const HeaderAPIKey = "X-Api-Key"
+
+const (
+	defaultLimit = 100
+	maxBodyBytes = 1 << 20
+)
+
+type Server struct {
+	rtw       *timewheel.RTimeWheel
+	apiKey    string
+	taskTypes []string
+}
+
+type Option func(s *Server)
+
+// WithAPIKey makes the server reject the requests without the API key.
+func WithAPIKey(apiKey string) Option {
+	return func(s *Server) {
+		s.apiKey = apiKey
+	}
+}
+
+// WithTaskTypes sets the executor types of the tasks clients may add, only
+// timewheel.ExecutorHTTP by default. Other types reach local resources, such as
+// Unix sockets or Redis keys, so they should only be allowed for trusted clients.
+func WithTaskTypes(types ...string) Option {
+	return func(s *Server) {
+		s.taskTypes = types
+	}
+}
+
+func NewServer(rtw *timewheel.RTimeWheel, opts ...Option) *Server {
+	s := Server{rtw: rtw}
+	for _, apply := range opts {
+		apply(&s)
+	}
+	if len(s.taskTypes) == 0 {
+		s.taskTypes = []string{timewheel.ExecutorHTTP}
+	}
+	return &s
+}
+
+type addTaskRequest struct {
+	Key           string           `json:"key"`
+	ExecutionTime time.Time        `json:"execution_time"`
+	Task          *timewheel.RTask `json:"task"`
+}
+
+type executionTimeRequest struct {
+	ExecutionTime time.Time `json:"execution_time"`
+}
+
+type taskResponse struct {
+	Key           string                `json:"key"`
+	Status        timewheel.RTaskStatus `json:"status"`
+	UpdatedAt     *time.Time            `json:"updated_at,omitempty"`
+	Error         string                `json:"error,omitempty"`
+	ExecutionTime *time.Time            `json:"execution_time,omitempty"`
+	Task          *timewheel.RTask      `json:"task,omitempty"`
+}
+
+// errBadRequest wraps the errors of invalid requests.
+type errBadRequest struct {
+	err error
+}
+
+func (e errBadRequest) Error() string {
+	return e.err.Error()
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return errBadRequest{fmt.Errorf(format, args...)}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "healthz" {
+		s.health(w, r)
+		return
+	}
+	if !s.authorized(r) {
+		writeError(w, http.StatusUnauthorized, errors.New("invalid api key"))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+
+	parts := strings.Split(path, "/")
+	var result interface{}
+	var err error
+	status := http.StatusOK
+	switch {
+	case len(parts) == 1 && parts[0] == "tasks" && r.Method == http.MethodPost:
+		result, err = s.addTask(r)
+		status = http.StatusCreated
+	case len(parts) == 1 && parts[0] == "tasks" && r.Method == http.MethodGet:
+		result, err = s.listTasks(r)
+	case len(parts) == 2 && parts[0] == "tasks" && r.Method == http.MethodGet:
+		result, err = s.getTask(r, parts[1])
+	case len(parts) == 2 && parts[0] == "tasks" && r.Method == http.MethodDelete:
+		err = s.rtw.RemoveTask(r.Context(), parts[1])
+		status = http.StatusNoContent
+	case len(parts) == 3 && parts[0] == "tasks" && parts[2] == "reschedule" && r.Method == http.MethodPost:
+		result, err = s.reschedule(r, parts[1])
+	case len(parts) == 1 && parts[0] == "dead-letters" && r.Method == http.MethodGet:
+		result, err = s.listDeadLetters(r)
+	case len(parts) == 2 && parts[0] == "dead-letters" && r.Method == http.MethodGet:
+		result, err = s.rtw.GetDeadLetter(r.Context(), parts[1])
+	case len(parts) == 2 && parts[0] == "dead-letters" && r.Method == http.MethodDelete:
+		err = s.purgeDeadLetter(r, parts[1])
+		status = http.StatusNoContent
+	case len(parts) == 3 && parts[0] == "dead-letters" && parts[2] == "replay" && r.Method == http.MethodPost:
+		err = s.replayDeadLetter(r, parts[1])
+		status = http.StatusNoContent
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no route for %s %s", r.Method, r.URL.Path))
+		return
+	}
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, status, result)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.apiKey == "" {
+		return true
+	}
+	key := r.Header.Get(HeaderAPIKey)
+	if key == "" {
+		key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(key), []byte(s.apiKey)) == 1
+}
+
+func (s *Server) allowed(taskType string) bool {
+	if taskType == "" {
+		taskType = timewheel.ExecutorHTTP
+	}
+	for _, t := range s.taskTypes {
+		if t == taskType {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if err := s.rtw.Ping(ctx); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) addTask(r *http.Request) (interface{}, error) {
+	var req addTaskRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest("invalid body: %v", err)
+	}
+	if req.Key == "" || req.Task == nil || req.ExecutionTime.IsZero() {
+		return nil, badRequest("key, execution_time and task are required")
+	}
+	if !s.allowed(req.Task.Type) {
+		return nil, badRequest("task type %s not allowed", req.Task.Type)
+	}
+	if err := s.rtw.AddTask(r.Context(), req.Key, req.Task, req.ExecutionTime); err != nil {
+		return nil, err
+	}
+	return s.getTask(r, req.Key)
+}
+
+func (s *Server) getTask(r *http.Request, key string) (interface{}, error) {
+	info, err := s.rtw.GetTask(r.Context(), key)
+	if err != nil {
+		return nil, err
+	}
+	resp := taskResponse{
+		Key:    key,
+		Status: info.Status,
+		Error:  info.Error,
+		Task:   info.Task,
+	}
+	if !info.UpdatedAt.IsZero() {
+		resp.UpdatedAt = &info.UpdatedAt
+	}
+	if !info.ExecutionTime.IsZero() {
+		resp.ExecutionTime = &info.ExecutionTime
+	}
+	return &resp, nil
+}
+
+func (s *Server) listTasks(r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	from, err := time.Parse(time.RFC3339, query.Get("from"))
+	if err != nil {
+		return nil, badRequest("invalid from: %v", err)
+	}
+	to, err := time.Parse(time.RFC3339, query.Get("to"))
+	if err != nil {
+		return nil, badRequest("invalid to: %v", err)
+	}
+	limit, err := intParam(query.Get("limit"), defaultLimit)
+	if err != nil {
+		return nil, err
+	}
+	if to.Before(from) || to.Sub(from) > timewheel.MaxListRange || limit <= 0 {
+		return nil, badRequest("invalid range from %v to %v or limit %d", from, to, limit)
+	}
+	infos, err := s.rtw.ListTasks(r.Context(), from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]*taskResponse, 0, len(infos))
+	for _, info := range infos {
+		info := info
+		tasks = append(tasks, &taskResponse{
+			Key:           info.Task.Key,
+			Status:        info.Status,
+			ExecutionTime: &info.ExecutionTime,
+			Task:          info.Task,
+		})
+	}
+	return tasks, nil
+}
+
+func (s *Server) reschedule(r *http.Request, key string) (interface{}, error) {
+	req, err := decodeExecutionTime(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.rtw.Reschedule(r.Context(), key, req.ExecutionTime); err != nil {
+		return nil, err
+	}
+	return s.getTask(r, key)
+}
+
+func (s *Server) listDeadLetters(r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	offset, err := intParam(query.Get("offset"), 0)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := intParam(query.Get("limit"), defaultLimit)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || limit <= 0 {
+		return nil, badRequest("invalid offset %d or limit %d", offset, limit)
+	}
+	return s.rtw.ListDeadLetters(r.Context(), offset, limit)
+}
+
+func (s *Server) replayDeadLetter(r *http.Request, key string) error {
+	req, err := decodeExecutionTime(r)
+	if err != nil {
+		return err
+	}
+	return s.rtw.ReplayDeadLetter(r.Context(), key, req.ExecutionTime)
+}
+
+func (s *Server) purgeDeadLetter(r *http.Request, key string) error {
+	n, err := s.rtw.PurgeDeadLetters(r.Context(), key)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return timewheel.ErrTaskNotFound
+	}
+	return nil
+}
+
+func decodeExecutionTime(r *http.Request) (*executionTimeRequest, error) {
+	var req executionTimeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest("invalid body: %v", err)
+	}
+	if req.ExecutionTime.IsZero() {
+		return nil, badRequest("execution_time is required")
+	}
+	return &req, nil
+}
+
+func intParam(value string, defaultValue int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, badRequest("invalid number %q", value)
+	}
+	return n, nil
+}
+
+func statusOf(err error) int {
+	var bad errBadRequest
+	switch {
+	case errors.As(err, &bad), errors.Is(err, timewheel.ErrInvalidTask):
+		return http.StatusBadRequest
+	case errors.Is(err, timewheel.ErrTaskNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, timewheel.ErrStopped):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,126 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Nicknamezz00/timewheel"
+	http2 "github.com/Nicknamezz00/timewheel/pkg/http"
+	"github.com/Nicknamezz00/timewheel/pkg/redis"
+)
+
+func TestServer(t *testing.T) {
+	client := redis.NewClient("tcp", "127.0.0.1:6379", "")
+	if err := client.Ping(context.Background()); err != nil {
+		t.Skipf("redis unavailable: %v", err)
+	}
+	rtw := timewheel.NewRTimeWheel(client, http2.NewClient())
+	server := httptest.NewServer(NewServer(rtw, WithAPIKey("secret")))
+	defer server.Close()
+	key := fmt.Sprintf("admin_%d", time.Now().UnixNano())
+
+	do := func(method, path, apiKey string, body interface{}) *http.Response {
+		var reader *bytes.Reader
+		if body == nil {
+			reader = bytes.NewReader(nil)
+		} else {
+			b, _ := json.Marshal(body)
+			reader = bytes.NewReader(b)
+		}
+		req, _ := http.NewRequest(method, server.URL+path, reader)
+		req.Header.Set(HeaderAPIKey, apiKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	executionTime := time.Now().Add(time.Hour)
+	tests := []struct {
+		method, path, apiKey string
+		body                 interface{}
+		expect               int
+	}{
+		{http.MethodGet, "/healthz", "", nil, http.StatusOK},
+		{http.MethodGet, "/tasks/" + key, "wrong", nil, http.StatusUnauthorized},
+		{http.MethodPost, "/tasks", "secret", map[string]interface{}{
+			"key": key, "execution_time": executionTime, "task": map[string]string{"method": "TRACE", "callback_url": "http://127.0.0.1"},
+		}, http.StatusBadRequest},
+		{http.MethodPost, "/tasks", "secret", map[string]interface{}{
+			"key": key, "execution_time": executionTime, "task": map[string]string{"type": "unix", "target": "/var/run/docker.sock"},
+		}, http.StatusBadRequest},
+		{http.MethodPost, "/tasks", "secret", map[string]interface{}{
+			"key": key, "execution_time": executionTime, "task": map[string]string{"body": string(make([]byte, maxBodyBytes))},
+		}, http.StatusBadRequest},
+		{http.MethodPost, "/tasks", "secret", map[string]interface{}{
+			"key": key, "execution_time": executionTime, "task": map[string]string{"method": "POST", "callback_url": "http://127.0.0.1"},
+		}, http.StatusCreated},
+		{http.MethodGet, "/tasks/" + key, "secret", nil, http.StatusOK},
+		{http.MethodGet, "/tasks?from=" + url.QueryEscape(time.Now().Format(time.RFC3339)) + "&to=" + url.QueryEscape(executionTime.Add(time.Minute).Format(time.RFC3339)), "secret", nil, http.StatusOK},
+		{http.MethodPost, "/tasks/" + key + "/reschedule", "secret", map[string]interface{}{"execution_time": executionTime.Add(time.Minute)}, http.StatusOK},
+		{http.MethodDelete, "/tasks/" + key, "secret", nil, http.StatusNoContent},
+		{http.MethodDelete, "/tasks/" + key, "secret", nil, http.StatusNotFound},
+		{http.MethodGet, "/dead-letters/" + key, "secret", nil, http.StatusNotFound},
+		{http.MethodGet, "/dead-letters", "secret", nil, http.StatusOK},
+		{http.MethodPut, "/tasks", "secret", nil, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if resp := do(test.method, test.path, test.apiKey, test.body); resp.StatusCode != test.expect {
+			t.Fatalf("%s %s returns %d, expect %d", test.method, test.path, resp.StatusCode, test.expect)
+		}
+	}
+
+	// times in UTC, or with any other offset, are due at the same instant as local ones
+	var calls int32
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer callback.Close()
+	rtw.Run()
+	defer rtw.Shutdown(context.Background())
+	due := time.Now().Add(2 * time.Second).UTC().Format(time.RFC3339)
+	if resp := do(http.MethodPost, "/tasks", "secret", map[string]interface{}{
+		"key": key, "execution_time": due, "task": map[string]string{"method": "POST", "callback_url": callback.URL},
+	}); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("add task due at %s returns %d", due, resp.StatusCode)
+	}
+	<-time.After(3500 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("task due at %s called back %d times, expect 1", due, n)
+	}
+}
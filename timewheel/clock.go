@@ -0,0 +1,187 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package timewheel
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of both wheels.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// FakeClock is a manually driven Clock for tests.
+//
+// Unlike time.Ticker, its tickers never drop ticks: Advance delivers every
+// tick that became due, one by one, waiting for each to be received.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	timers  []*fakeTimer
+}
+
+type fakeTicker struct {
+	clock  *FakeClock
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+	stopCh chan struct{}
+}
+
+type fakeTimer struct {
+	c        chan time.Time
+	deadline time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{
+		clock:  c,
+		c:      make(chan time.Time),
+		period: d,
+		next:   c.now.Add(d),
+		stopCh: make(chan struct{}),
+	}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{
+		c:        make(chan time.Time, 1),
+		deadline: c.now.Add(d),
+	}
+	if d <= 0 {
+		t.c <- c.now
+		return t.c
+	}
+	c.timers = append(c.timers, t)
+	return t.c
+}
+
+// Advance moves the clock forward by d, firing the timers and tickers
+// which become due in chronological order.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	for {
+		var ticker *fakeTicker
+		timer := -1
+		next := target
+		for i, t := range c.timers {
+			if !t.deadline.After(next) {
+				timer, next = i, t.deadline
+			}
+		}
+		for _, t := range c.tickers {
+			if t.next.Before(next) || (timer < 0 && t.next.Equal(next)) {
+				ticker, timer, next = t, -1, t.next
+			}
+		}
+		c.now = next
+		switch {
+		case timer >= 0:
+			t := c.timers[timer]
+			c.timers = append(c.timers[:timer], c.timers[timer+1:]...)
+			t.c <- next
+		case ticker != nil:
+			ticker.next = ticker.next.Add(ticker.period)
+			c.mu.Unlock()
+			select {
+			case ticker.c <- next:
+			case <-ticker.stopCh:
+			}
+			c.mu.Lock()
+		default:
+			c.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, ticker := range c.tickers {
+		if ticker == t {
+			c.tickers = append(c.tickers[:i], c.tickers[i+1:]...)
+			close(t.stopCh)
+			return
+		}
+	}
+}
@@ -0,0 +1,185 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Nicknamezz00/timewheel"
+	"github.com/Nicknamezz00/timewheel/pkg/redis"
+	"github.com/Nicknamezz00/timewheel/pkg/signature"
+	"gopkg.in/yaml.v3"
+)
+
+// Config of timewheeld, read from YAML or, as a subset of it, JSON.
+// Durations are strings such as "1s" or "5m".
+type Config struct {
+	Redis struct {
+		Network            string `yaml:"network"`
+		Address            string `yaml:"address"`
+		Password           string `yaml:"password"`
+		MaxIdle            int    `yaml:"max_idle"`
+		MaxActive          int    `yaml:"max_active"`
+		IdleTimeoutSeconds int    `yaml:"idle_timeout_seconds"`
+		Wait               bool   `yaml:"wait"`
+	} `yaml:"redis"`
+	Namespace       string        `yaml:"namespace"`
+	PollInterval    time.Duration `yaml:"poll_interval"`
+	Lease           time.Duration `yaml:"lease"`
+	MaxLookback     time.Duration `yaml:"max_lookback"`
+	StatusTTL       time.Duration `yaml:"status_ttl"`
+	CallbackTimeout time.Duration `yaml:"callback_timeout"`
+	MaxInFlight     int           `yaml:"max_in_flight"`
+	MaxPerHost      int           `yaml:"max_per_host"`
+	LeaderElection  struct {
+		ID  string        `yaml:"id"`
+		TTL time.Duration `yaml:"ttl"`
+	} `yaml:"leader_election"`
+	SigningKeys []struct {
+		ID     string `yaml:"id"`
+		Secret string `yaml:"secret"`
+	} `yaml:"signing_keys"`
+	// Executors lists the enabled built-in executors, also the task types the
+	// admin API accepts, only http if empty.
+	Executors []string `yaml:"executors"`
+	Admin     struct {
+		Listen string `yaml:"listen"`
+		APIKey string `yaml:"api_key"`
+	} `yaml:"admin"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+var builtinExecutors = []string{
+	timewheel.ExecutorHTTP,
+	timewheel.ExecutorRedisList,
+	timewheel.ExecutorRedisStream,
+	timewheel.ExecutorFunc,
+	timewheel.ExecutorUnix,
+}
+
+func loadConfig(path string) (*Config, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := yaml.Unmarshal(body, &c); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	if c.Redis.Network == "" {
+		c.Redis.Network = "tcp"
+	}
+	if c.Redis.Address == "" {
+		c.Redis.Address = "127.0.0.1:6379"
+	}
+	if c.Admin.Listen == "" {
+		c.Admin.Listen = "127.0.0.1:8080"
+	}
+	if c.Admin.APIKey == "" && !loopback(c.Admin.Listen) {
+		return nil, fmt.Errorf("invalid config %s: admin.api_key is required to listen on %s", path, c.Admin.Listen)
+	}
+	if c.ShutdownTimeout <= 0 {
+		c.ShutdownTimeout = 30 * time.Second
+	}
+	if strings.ContainsAny(c.Namespace, "{}") {
+		return nil, fmt.Errorf("invalid config %s: namespace %s contains braces", path, c.Namespace)
+	}
+	if len(c.Executors) == 0 {
+		c.Executors = []string{timewheel.ExecutorHTTP}
+	}
+	for _, typ := range c.Executors {
+		if !contains(builtinExecutors, typ) {
+			return nil, fmt.Errorf("invalid config %s: unknown executor %s", path, typ)
+		}
+	}
+	return &c, nil
+}
+
+func (c *Config) redisOptions() []redis.ClientOption {
+	var opts []redis.ClientOption
+	if c.Redis.MaxIdle > 0 {
+		opts = append(opts, redis.WithMaxIdle(c.Redis.MaxIdle))
+	}
+	if c.Redis.MaxActive > 0 {
+		opts = append(opts, redis.WithMaxActive(c.Redis.MaxActive))
+	}
+	if c.Redis.IdleTimeoutSeconds > 0 {
+		opts = append(opts, redis.WithIdleTimeoutSeconds(c.Redis.IdleTimeoutSeconds))
+	}
+	if c.Redis.Wait {
+		opts = append(opts, redis.WithWait())
+	}
+	return opts
+}
+
+func (c *Config) wheelOptions() []timewheel.Option {
+	opts := []timewheel.Option{
+		timewheel.WithNamespace(c.Namespace),
+		timewheel.WithPollInterval(c.PollInterval),
+		timewheel.WithLease(c.Lease),
+		timewheel.WithMaxLookback(c.MaxLookback),
+		timewheel.WithStatusTTL(c.StatusTTL),
+		timewheel.WithCallbackTimeout(c.CallbackTimeout),
+		timewheel.WithMaxInFlight(c.MaxInFlight),
+		timewheel.WithMaxPerHost(c.MaxPerHost),
+	}
+	if c.LeaderElection.ID != "" {
+		opts = append(opts, timewheel.WithLeaderElection(c.LeaderElection.ID, c.LeaderElection.TTL))
+	}
+	if len(c.SigningKeys) > 0 {
+		keys := make([]signature.Key, 0, len(c.SigningKeys))
+		for _, key := range c.SigningKeys {
+			keys = append(keys, signature.Key{ID: key.ID, Secret: []byte(key.Secret)})
+		}
+		opts = append(opts, timewheel.WithSigningKeys(keys...))
+	}
+	return opts
+}
+
+// loopback reports whether the listen address only accepts local connections.
+func loopback(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Nicknamezz00/timewheel"
+)
+
+func TestLoadConfig(t *testing.T) {
+	write := func(body string) string {
+		path := filepath.Join(t.TempDir(), "timewheeld.yaml")
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	config, err := loadConfig(write("poll_interval: 2s\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Admin.Listen != "127.0.0.1:8080" || config.Redis.Address != "127.0.0.1:6379" || config.ShutdownTimeout != 30*time.Second {
+		t.Fatalf("got %+v, expect the defaults", config)
+	}
+	if len(config.Executors) != 1 || config.Executors[0] != timewheel.ExecutorHTTP {
+		t.Fatalf("got executors %v, expect only http", config.Executors)
+	}
+	if config.PollInterval != 2*time.Second {
+		t.Fatalf("got poll interval %v, expect 2s", config.PollInterval)
+	}
+	if _, err := loadConfig(write(`{"admin": {"listen": "[::1]:9090"}, "executors": ["http", "unix"]}`)); err != nil {
+		t.Fatalf("got %v, expect JSON with a loopback listen address accepted", err)
+	}
+
+	for _, body := range []string{
+		"admin:\n  listen: \":8080\"\n",
+		"admin:\n  listen: \"0.0.0.0:8080\"\n",
+		"executors: [http, ftp]\n",
+		"namespace: \"{a}\"\n",
+		"poll_interval: often\n",
+	} {
+		if _, err := loadConfig(write(body)); err == nil {
+			t.Fatalf("expect %q rejected", body)
+		}
+	}
+	if _, err := loadConfig(write("admin:\n  listen: \":8080\"\n  api_key: secret\n")); err != nil {
+		t.Fatalf("got %v, expect any listen address accepted with an api key", err)
+	}
+}
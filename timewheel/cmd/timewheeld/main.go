@@ -0,0 +1,135 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+// Command timewheeld runs an RTimeWheel along with its admin API.
+//
+//	timewheeld -config timewheeld.yaml
+//
+// Besides the admin API, it serves /livez, /readyz which fails once draining,
+// and /metrics in the Prometheus text format. On SIGTERM or SIGINT it stops polling, waits for the running
+// callbacks up to the shutdown timeout, and exits.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Nicknamezz00/timewheel"
+	"github.com/Nicknamezz00/timewheel/admin"
+	http2 "github.com/Nicknamezz00/timewheel/pkg/http"
+	"github.com/Nicknamezz00/timewheel/pkg/redis"
+)
+
+func main() {
+	path := flag.String("config", "timewheeld.yaml", "path of the YAML or JSON config")
+	flag.Parse()
+	config, err := loadConfig(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := run(config); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(config *Config) error {
+	redisClient := redis.NewClient(config.Redis.Network, config.Redis.Address, config.Redis.Password, config.redisOptions()...)
+	metrics := timewheel.NewMetrics()
+	rtw := timewheel.NewRTimeWheel(redisClient, http2.NewClient(), append(config.wheelOptions(), timewheel.WithHooks(metrics))...)
+	metrics.SetPending(rtw.Len)
+	for _, typ := range builtinExecutors {
+		if !contains(config.Executors, typ) {
+			rtw.UnregisterExecutor(typ)
+		}
+	}
+
+	var draining atomic.Bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		if draining.Load() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		if err := rtw.Ping(ctx); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.Handle("/metrics", metrics)
+	adminOpts := []admin.Option{admin.WithTaskTypes(config.Executors...)}
+	if config.Admin.APIKey != "" {
+		adminOpts = append(adminOpts, admin.WithAPIKey(config.Admin.APIKey))
+	}
+	mux.Handle("/", admin.NewServer(rtw, adminOpts...))
+	server := &http.Server{
+		Addr:              config.Admin.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	rtw.Run()
+	log.Printf("timewheeld serving on %s", config.Admin.Listen)
+
+	select {
+	case <-ctx.Done():
+		log.Printf("draining for up to %v", config.ShutdownTimeout)
+	case err := <-serveErr:
+		rtw.Stop()
+		return err
+	}
+	draining.Store(true)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	wheelErr := rtw.Shutdown(shutdownCtx)
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	if wheelErr != nil {
+		return wheelErr
+	}
+	log.Printf("timewheeld stopped")
+	return nil
+}
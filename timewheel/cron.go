@@ -0,0 +1,312 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package timewheel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule yields the activation times of a recurring task.
+type Schedule interface {
+	// Next returns the next activation time later than t,
+	// or the zero time if there is none.
+	Next(t time.Time) time.Time
+}
+
+type everySchedule struct {
+	every time.Duration
+}
+
+// Every returns a Schedule firing at a fixed interval.
+func Every(every time.Duration) Schedule {
+	return everySchedule{every: every}
+}
+
+func (s everySchedule) Next(t time.Time) time.Time {
+	return t.Add(s.every)
+}
+
+func (s everySchedule) String() string {
+	return "@every " + s.every.String()
+}
+
+// maxCronSteps bounds the steps of CronSchedule.Next.
+const maxCronSteps = 1 << 16
+
+// CronSchedule is a parsed cron expression, see ParseCron.
+type CronSchedule struct {
+	spec     string
+	second   uint64
+	minute   uint64
+	hour     uint64
+	dom      uint64
+	month    uint64
+	dow      uint64
+	location *time.Location
+}
+
+// starBit marks a field that was given as "*" or "?", which matters for
+// the day-of-month / day-of-week combination.
+const starBit = 1 << 63
+
+type bounds struct {
+	min, max uint
+	names    map[string]uint
+}
+
+var (
+	secondBounds = bounds{0, 59, nil}
+	minuteBounds = bounds{0, 59, nil}
+	hourBounds   = bounds{0, 23, nil}
+	domBounds    = bounds{1, 31, nil}
+	monthBounds  = bounds{1, 12, map[string]uint{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dowBounds = bounds{0, 7, map[string]uint{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+// ParseCron parses a standard cron expression.
+//
+// Both the 5-field form (minute hour day-of-month month day-of-week) and the
+// 6-field form with a leading seconds field are accepted, as well as the
+// @yearly, @monthly, @weekly, @daily, @hourly and "@every <duration>" descriptors.
+// Fields support "*", "?", lists, ranges, steps and month / weekday names.
+// The expression is evaluated in the local time zone unless it is prefixed with
+// "CRON_TZ=<zone>" or "TZ=<zone>", e.g. "CRON_TZ=Asia/Shanghai 0 9 * * MON-FRI".
+func ParseCron(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	loc := time.Local
+	if strings.HasPrefix(spec, "CRON_TZ=") || strings.HasPrefix(spec, "TZ=") {
+		i := strings.IndexAny(spec, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid cron spec: %q", spec)
+		}
+		var err error
+		if loc, err = time.LoadLocation(spec[strings.Index(spec, "=")+1 : i]); err != nil {
+			return nil, fmt.Errorf("invalid cron time zone: %w", err)
+		}
+		spec = strings.TrimSpace(spec[i:])
+	}
+
+	if strings.HasPrefix(spec, "@every ") {
+		every, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron spec: %w", err)
+		}
+		if every <= 0 {
+			return nil, fmt.Errorf("invalid cron spec: non-positive interval %v", every)
+		}
+		return Every(every), nil
+	}
+
+	fields := strings.Fields(spec)
+	if strings.HasPrefix(spec, "@") {
+		expanded, ok := descriptors[spec]
+		if !ok {
+			return nil, fmt.Errorf("invalid cron descriptor: %q", spec)
+		}
+		fields = strings.Fields(expanded)
+	}
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("invalid cron spec %q: expect 5 or 6 fields, got %d", spec, len(fields))
+	}
+
+	s := &CronSchedule{spec: spec, location: loc}
+	var err error
+	for i, field := range []struct {
+		bits *uint64
+		b    bounds
+	}{
+		{&s.second, secondBounds},
+		{&s.minute, minuteBounds},
+		{&s.hour, hourBounds},
+		{&s.dom, domBounds},
+		{&s.month, monthBounds},
+		{&s.dow, dowBounds},
+	} {
+		if *field.bits, err = parseCronField(fields[i], field.b); err != nil {
+			return nil, fmt.Errorf("invalid cron spec %q: %w", spec, err)
+		}
+	}
+	if s.dow&(1<<7) > 0 {
+		// both 0 and 7 stand for sunday
+		s.dow = s.dow&^(1<<7) | 1
+	}
+	return s, nil
+}
+
+func parseCronField(field string, b bounds) (uint64, error) {
+	var bits uint64
+	for _, expr := range strings.Split(field, ",") {
+		r, step := expr, uint(1)
+		if i := strings.Index(expr, "/"); i >= 0 {
+			n, err := strconv.ParseUint(expr[i+1:], 10, 8)
+			if err != nil || n == 0 {
+				return 0, fmt.Errorf("invalid step in %q", expr)
+			}
+			r, step = expr[:i], uint(n)
+		}
+
+		var start, end uint
+		switch {
+		case r == "*" || r == "?":
+			start, end = b.min, b.max
+			if step == 1 {
+				bits |= starBit
+			}
+		case strings.Contains(r, "-"):
+			i := strings.Index(r, "-")
+			var err error
+			if start, err = parseCronValue(r[:i], b); err != nil {
+				return 0, err
+			}
+			if end, err = parseCronValue(r[i+1:], b); err != nil {
+				return 0, err
+			}
+		default:
+			v, err := parseCronValue(r, b)
+			if err != nil {
+				return 0, err
+			}
+			start, end = v, v
+			if step > 1 {
+				end = b.max
+			}
+		}
+		if start > end {
+			return 0, fmt.Errorf("invalid range %q", expr)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(s string, b bounds) (uint, error) {
+	if v, ok := b.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	v := uint(n)
+	if v < b.min || v > b.max {
+		return 0, fmt.Errorf("value %d out of range [%d, %d]", v, b.min, b.max)
+	}
+	return v, nil
+}
+
+func (s *CronSchedule) String() string {
+	if s.location == time.Local {
+		return s.spec
+	}
+	return "CRON_TZ=" + s.location.String() + " " + s.spec
+}
+
+// Next returns the first time later than t matching the expression,
+// or the zero time if there is none within the next five years.
+// Wall-clock times skipped by a daylight saving transition never
+// match, and those repeated by one match on both occurrences.
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	origin := t.Location()
+	t = t.In(s.location)
+	t = t.Add(time.Second - time.Duration(t.Nanosecond()))
+	yearLimit := t.Year() + 5
+	steps := 0
+
+	// every step moves t forward to the start of the next candidate
+	// month, day, hour, minute or second; the budget only keeps a
+	// stepping bug from spinning the caller forever
+WRAP:
+	if steps++; t.Year() > yearLimit || steps > maxCronSteps {
+		return time.Time{}
+	}
+	if 1<<uint(t.Month())&s.month == 0 {
+		t = s.midnight(t.Year(), t.Month()+1, 1)
+		goto WRAP
+	}
+	if !s.dayMatches(t) {
+		t = s.midnight(t.Year(), t.Month(), t.Day()+1)
+		goto WRAP
+	}
+	if 1<<uint(t.Hour())&s.hour == 0 {
+		t = t.Truncate(time.Minute).Add(time.Duration(60-t.Minute()) * time.Minute)
+		goto WRAP
+	}
+	if 1<<uint(t.Minute())&s.minute == 0 {
+		t = t.Truncate(time.Minute).Add(time.Minute)
+		goto WRAP
+	}
+	if 1<<uint(t.Second())&s.second == 0 {
+		t = t.Truncate(time.Second).Add(time.Second)
+		goto WRAP
+	}
+	return t.In(origin)
+}
+
+// midnight returns the start of the given day. time.Date may normalize
+// a midnight skipped by a daylight saving transition back into the day
+// before, so it steps forward until the day is reached.
+func (s *CronSchedule) midnight(year int, month time.Month, day int) time.Time {
+	t := time.Date(year, month, day, 0, 0, 0, 0, s.location)
+	noon := time.Date(year, month, day, 12, 0, 0, 0, s.location)
+	for t.Day() != noon.Day() {
+		t = t.Add(time.Hour)
+	}
+	return t
+}
+
+// dayMatches follows the usual cron rule: when both day fields are
+// restricted, a day matching either of them is accepted.
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	domMatch := 1<<uint(t.Day())&s.dom > 0
+	dowMatch := 1<<uint(t.Weekday())&s.dow > 0
+	if s.dom&starBit > 0 || s.dow&starBit > 0 {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
@@ -0,0 +1,111 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package timewheel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	from := time.Date(2023, 6, 14, 10, 2, 30, 0, time.UTC) // a wednesday
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"*/5 * * * *", time.Date(2023, 6, 14, 10, 5, 0, 0, time.UTC)},
+		{"*/20 * * * * *", time.Date(2023, 6, 14, 10, 2, 40, 0, time.UTC)},
+		{"0 9 * * MON-FRI", time.Date(2023, 6, 15, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2023, 6, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 7", time.Date(2023, 6, 18, 0, 0, 0, 0, time.UTC)},
+		{"30 4 29 feb *", time.Date(2024, 2, 29, 4, 30, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+		{"@hourly", time.Date(2023, 6, 14, 11, 0, 0, 0, time.UTC)},
+		{"@every 90s", time.Date(2023, 6, 14, 10, 4, 0, 0, time.UTC)},
+		{"CRON_TZ=Asia/Shanghai 0 9 * * *", time.Date(2023, 6, 15, 9, 0, 0, 0, shanghai)},
+	}
+	for _, test := range tests {
+		schedule, err := ParseCron(test.spec)
+		if err != nil {
+			t.Errorf("parse %q: %v", test.spec, err)
+			continue
+		}
+		if got := schedule.Next(from.In(time.UTC)); !got.Equal(test.want) {
+			t.Errorf("%q: next of %v is %v, expect %v", test.spec, from, got, test.want)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * * * * * *", "*/0 * * * *", "5-1 * * * *", "@never", "TZ=Nowhere/Land * * * * *"} {
+		if _, err := ParseCron(spec); err == nil {
+			t.Errorf("parse %q: expect error", spec)
+		}
+	}
+}
+
+func TestCronDaylightSaving(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		spec string
+		from time.Time
+		want []time.Time
+	}{
+		// 2:30 does not exist on 2023-03-12.
+		{"CRON_TZ=America/New_York 30 2 * * *", time.Date(2023, 3, 11, 3, 0, 0, 0, newYork), []time.Time{
+			time.Date(2023, 3, 13, 2, 30, 0, 0, newYork),
+		}},
+		{"CRON_TZ=America/New_York 0 * * * *", time.Date(2023, 3, 12, 0, 30, 0, 0, newYork), []time.Time{
+			time.Date(2023, 3, 12, 1, 0, 0, 0, newYork),
+			time.Date(2023, 3, 12, 3, 0, 0, 0, newYork),
+		}},
+		// 1:30 happens twice on 2023-11-05.
+		{"CRON_TZ=America/New_York 30 1 * * *", time.Date(2023, 11, 5, 0, 0, 0, 0, newYork), []time.Time{
+			time.Date(2023, 11, 5, 5, 30, 0, 0, time.UTC),
+			time.Date(2023, 11, 5, 6, 30, 0, 0, time.UTC),
+			time.Date(2023, 11, 6, 6, 30, 0, 0, time.UTC),
+		}},
+	}
+	for _, test := range tests {
+		schedule, err := ParseCron(test.spec)
+		if err != nil {
+			t.Fatalf("parse %q: %v", test.spec, err)
+		}
+		from := test.from
+		for _, want := range test.want {
+			got := schedule.Next(from)
+			if !got.Equal(want) {
+				t.Errorf("%q: next of %v is %v, expect %v", test.spec, from, got, want)
+				break
+			}
+			from = got
+		}
+	}
+}
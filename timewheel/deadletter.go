@@ -0,0 +1,207 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package timewheel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	http2 "github.com/Nicknamezz00/timewheel/pkg/http"
+	"github.com/demdxx/gocast"
+)
+
+// DeadLetter is an RTask whose callback kept failing after all its retries.
+// There is at most one dead letter per task key, the latest one.
+type DeadLetter struct {
+	Task       *RTask          `json:"task"`
+	LastError  string          `json:"last_error"`
+	StatusCode int             `json:"status_code,omitempty"`
+	Attempts   []AttemptRecord `json:"attempts"`
+	FailedAt   time.Time       `json:"failed_at"`
+}
+
+// AttemptRecord describes a failed attempt of an RTask.
+type AttemptRecord struct {
+	At         time.Time `json:"at"`
+	Error      string    `json:"error"`
+	StatusCode int       `json:"status_code,omitempty"`
+}
+
+// fail records a failed attempt of the task, then retries it or turns it into a dead letter.
+func (r *RTimeWheel) fail(ctx context.Context, task *RTask, err error) {
+	record := AttemptRecord{
+		At:    r.clock.Now(),
+		Error: err.Error(),
+	}
+	var statusErr *http2.StatusError
+	if errors.As(err, &statusErr) {
+		record.StatusCode = statusErr.StatusCode
+	}
+	task.History = append(task.History, record)
+	if r.retry(ctx, task) {
+		return
+	}
+	if err := r.addDeadLetter(ctx, task); err != nil {
+		log.Printf("cannot add dead letter %s: %v", task.Key, err)
+	}
+}
+
+func (r *RTimeWheel) addDeadLetter(ctx context.Context, task *RTask) error {
+	last := task.History[len(task.History)-1]
+	letter := DeadLetter{
+		Task:       task,
+		LastError:  last.Error,
+		StatusCode: last.StatusCode,
+		Attempts:   task.History,
+		FailedAt:   last.At,
+	}
+	task.History = nil
+	body, _ := json.Marshal(&letter)
+	_, err := r.redisClient.Eval(ctx, LuaAddDeadLetter, 3, []interface{}{
+		r.getDeadLetterKey(),
+		r.getDeadLetterIndexKey(),
+		r.getInflightKey(),
+		task.Key,
+		string(body),
+		letter.FailedAt.Unix(),
+		task.claimed,
+		r.getStatusKeyPrefix(),
+		letter.LastError,
+		r.statusTTLSeconds(),
+	})
+	return err
+}
+
+// ListDeadLetters returns up to limit dead letters, most recent first, skipping the first offset ones.
+func (r *RTimeWheel) ListDeadLetters(ctx context.Context, offset, limit int) ([]*DeadLetter, error) {
+	if offset < 0 || limit <= 0 {
+		return nil, fmt.Errorf("invalid offset %d or limit %d", offset, limit)
+	}
+	rawReply, err := r.redisClient.Eval(ctx, LuaListDeadLetters, 2, []interface{}{
+		r.getDeadLetterKey(),
+		r.getDeadLetterIndexKey(),
+		offset,
+		offset + limit - 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	replies := gocast.ToInterfaceSlice(rawReply)
+	letters := make([]*DeadLetter, 0, len(replies))
+	for _, reply := range replies {
+		if reply == nil {
+			continue
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(gocast.ToString(reply)), &letter); err != nil {
+			log.Printf("error at unmarshal: %v", err)
+			continue
+		}
+		letters = append(letters, &letter)
+	}
+	return letters, nil
+}
+
+// GetDeadLetter returns the dead letter of the given task key, or ErrTaskNotFound.
+func (r *RTimeWheel) GetDeadLetter(ctx context.Context, key string) (*DeadLetter, error) {
+	letter, _, err := r.getDeadLetter(ctx, key)
+	return letter, err
+}
+
+func (r *RTimeWheel) getDeadLetter(ctx context.Context, key string) (*DeadLetter, string, error) {
+	rawReply, err := r.redisClient.Eval(ctx, LuaGetDeadLetter, 1, []interface{}{
+		r.getDeadLetterKey(),
+		key,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if rawReply == nil {
+		return nil, "", ErrTaskNotFound
+	}
+	body := gocast.ToString(rawReply)
+	var letter DeadLetter
+	if err := json.Unmarshal([]byte(body), &letter); err != nil {
+		return nil, "", err
+	}
+	return &letter, body, nil
+}
+
+// ReplayDeadLetter schedules the task of a dead letter again at executionTime,
+// with its attempts reset, and removes the dead letter.
+func (r *RTimeWheel) ReplayDeadLetter(ctx context.Context, key string, executionTime time.Time) error {
+	letter, body, err := r.getDeadLetter(ctx, key)
+	if err != nil {
+		return err
+	}
+	executionTime = r.nextExecutionTime(executionTime)
+	task := letter.Task
+	task.Attempt = 0
+	// a replayed occurrence of a schedule is a one-shot task
+	task.Schedule, task.Generation = "", ""
+	taskBody, _ := json.Marshal(task)
+	replayed, err := r.redisClient.Eval(ctx, LuaReplayDeadLetter, 4, []interface{}{
+		r.getDeadLetterKey(),
+		r.getDeadLetterIndexKey(),
+		r.getMinuteSlice(executionTime),
+		r.getIndexKey(),
+		key,
+		body,
+		executionTime.Unix(),
+		string(taskBody),
+		r.getStatusKeyPrefix(),
+		r.clock.Now().Unix(),
+		r.slotRetentionSeconds(),
+	})
+	if err != nil {
+		return err
+	}
+	if gocast.ToInt(replayed) == 0 {
+		return fmt.Errorf("dead letter %s changed while replaying it", key)
+	}
+	r.hooks.OnScheduled(Event{Key: key, ExecutionTime: executionTime})
+	return nil
+}
+
+// PurgeDeadLetters deletes the dead letters of the given task keys, or all of them
+// if no key is given, and returns how many were deleted.
+func (r *RTimeWheel) PurgeDeadLetters(ctx context.Context, keys ...string) (int, error) {
+	keysAndArgs := []interface{}{
+		r.getDeadLetterKey(),
+		r.getDeadLetterIndexKey(),
+	}
+	for _, key := range keys {
+		keysAndArgs = append(keysAndArgs, key)
+	}
+	n, err := r.redisClient.Eval(ctx, LuaPurgeDeadLetters, 2, keysAndArgs)
+	if err != nil {
+		return 0, err
+	}
+	return gocast.ToInt(n), nil
+}
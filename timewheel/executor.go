@@ -0,0 +1,262 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package timewheel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	http2 "github.com/Nicknamezz00/timewheel/pkg/http"
+	"github.com/Nicknamezz00/timewheel/pkg/redis"
+	"github.com/Nicknamezz00/timewheel/pkg/signature"
+)
+
+// Types of the built-in executors. The body of the task, see RTask.Req, Form
+// and Body, is what all but ExecutorFunc deliver.
+const (
+	ExecutorHTTP        = "http"         // request to CallbackURL, the default
+	ExecutorRedisList   = "redis_list"   // LPUSH to the list Target
+	ExecutorRedisStream = "redis_stream" // XADD key and body fields to the stream Target
+	ExecutorFunc        = "func"         // call of the Handler registered as Target
+	ExecutorUnix        = "unix"         // write to the Unix socket Target
+)
+
+// Executor delivers the due RTasks of a Type.
+type Executor interface {
+	// Check validates a task when it is added.
+	Check(task *RTask) error
+	Execute(ctx context.Context, task *RTask) error
+}
+
+// Handler is an in-process function called by ExecutorFunc.
+type Handler func(ctx context.Context, task *RTask) error
+
+// RegisterExecutor registers executor for the tasks of type typ, replacing the
+// built-in one if any.
+func (r *RTimeWheel) RegisterExecutor(typ string, executor Executor) {
+	r.executorsMu.Lock()
+	defer r.executorsMu.Unlock()
+	r.executors[typ] = executor
+}
+
+// UnregisterExecutor disables the tasks of type typ, which are then invalid.
+func (r *RTimeWheel) UnregisterExecutor(typ string) {
+	r.executorsMu.Lock()
+	defer r.executorsMu.Unlock()
+	delete(r.executors, typ)
+}
+
+// RegisterHandler registers handler under name for the tasks of type ExecutorFunc.
+func (r *RTimeWheel) RegisterHandler(name string, handler Handler) {
+	r.handlers.register(name, handler)
+}
+
+func (r *RTimeWheel) executor(typ string) (Executor, error) {
+	if typ == "" {
+		typ = ExecutorHTTP
+	}
+	r.executorsMu.RLock()
+	defer r.executorsMu.RUnlock()
+	executor, ok := r.executors[typ]
+	if !ok {
+		return nil, fmt.Errorf("invalid type: %s", typ)
+	}
+	return executor, nil
+}
+
+func (r *RTimeWheel) execute(ctx context.Context, task *RTask) error {
+	executor, err := r.executor(task.Type)
+	if err != nil {
+		return err
+	}
+	return executor.Execute(ctx, task)
+}
+
+func (r *RTimeWheel) registerBuiltinExecutors() {
+	r.handlers = &funcExecutor{handlers: make(map[string]Handler)}
+	r.executors = map[string]Executor{
+		ExecutorHTTP:        &httpExecutor{client: r.httpClient, clock: r.clock, signingKeys: r.signingKeys},
+		ExecutorRedisList:   &redisListExecutor{client: r.redisClient},
+		ExecutorRedisStream: &redisStreamExecutor{client: r.redisClient},
+		ExecutorFunc:        r.handlers,
+		ExecutorUnix:        unixExecutor{},
+	}
+}
+
+type httpExecutor struct {
+	client      *http2.Client
+	clock       Clock
+	signingKeys []signature.Key
+}
+
+func (e *httpExecutor) Check(task *RTask) error {
+	return task.checkCallback()
+}
+
+func (e *httpExecutor) Execute(ctx context.Context, task *RTask) error {
+	body, contentType, err := task.payload()
+	if err != nil {
+		return err
+	}
+	url, err := task.url()
+	if err != nil {
+		return err
+	}
+	header := make(map[string]string, len(task.Header)+4)
+	if contentType != "" {
+		header["Content-Type"] = contentType
+	}
+	for k, v := range task.Header {
+		header[k] = v
+	}
+	if len(e.signingKeys) > 0 {
+		for k, v := range signature.Header(e.signingKeys, e.clock.Now(), task.Key, body) {
+			header[k] = v
+		}
+	}
+	statusCode, err := e.client.Do(ctx, task.Method, url, header, body)
+	if err != nil {
+		return err
+	}
+	return task.checkStatus(statusCode)
+}
+
+type redisListExecutor struct {
+	client *redis.Client
+}
+
+func (e *redisListExecutor) Check(task *RTask) error {
+	if err := checkRedisTarget(task.Target); err != nil {
+		return err
+	}
+	return task.checkBody()
+}
+
+func (e *redisListExecutor) Execute(ctx context.Context, task *RTask) error {
+	body, _, err := task.payload()
+	if err != nil {
+		return err
+	}
+	_, err = e.client.LPush(ctx, task.Target, string(body))
+	return err
+}
+
+type redisStreamExecutor struct {
+	client *redis.Client
+}
+
+func (e *redisStreamExecutor) Check(task *RTask) error {
+	if err := checkRedisTarget(task.Target); err != nil {
+		return err
+	}
+	return task.checkBody()
+}
+
+// checkRedisTarget rejects the keys of the wheels themselves, which a push
+// would turn into lists or streams, breaking the scripts using them.
+func checkRedisTarget(target string) error {
+	if target == "" {
+		return fmt.Errorf("empty target")
+	}
+	if strings.HasPrefix(target, keyPrefix) {
+		return fmt.Errorf("target %s is a key of the timewheel", target)
+	}
+	return nil
+}
+
+func (e *redisStreamExecutor) Execute(ctx context.Context, task *RTask) error {
+	body, _, err := task.payload()
+	if err != nil {
+		return err
+	}
+	_, err = e.client.XAdd(ctx, task.Target, "key", task.Key, "body", string(body))
+	return err
+}
+
+type funcExecutor struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+func (e *funcExecutor) register(name string, handler Handler) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.handlers[name] = handler
+}
+
+func (e *funcExecutor) handler(name string) (Handler, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	handler, ok := e.handlers[name]
+	if !ok {
+		return nil, fmt.Errorf("unregistered handler: %s", name)
+	}
+	return handler, nil
+}
+
+func (e *funcExecutor) Check(task *RTask) error {
+	if _, err := e.handler(task.Target); err != nil {
+		return err
+	}
+	return task.checkBody()
+}
+
+func (e *funcExecutor) Execute(ctx context.Context, task *RTask) error {
+	handler, err := e.handler(task.Target)
+	if err != nil {
+		return err
+	}
+	return handler(ctx, task)
+}
+
+type unixExecutor struct{}
+
+func (unixExecutor) Check(task *RTask) error {
+	if task.Target == "" {
+		return fmt.Errorf("empty target")
+	}
+	return task.checkBody()
+}
+
+func (unixExecutor) Execute(ctx context.Context, task *RTask) error {
+	body, _, err := task.payload()
+	if err != nil {
+		return err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", task.Target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+	}
+	_, err = conn.Write(body)
+	return err
+}
@@ -3,7 +3,9 @@ module github.com/Nicknamezz00/timewheel
 go 1.20
 
 require (
-	github.com/demdxx/gocast v1.2.0 // indirect
-	github.com/gomodule/redigo v1.9.1 // indirect
-	github.com/pkg/errors v0.9.1 // indirect
+	github.com/demdxx/gocast v1.2.0
+	github.com/gomodule/redigo v1.9.1
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require github.com/pkg/errors v0.9.1 // indirect
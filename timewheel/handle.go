@@ -0,0 +1,212 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package timewheel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Job is a task body which can observe cancellation and report an error.
+// Its context is cancelled when the wheel is stopped.
+type Job func(ctx context.Context) error
+
+type TaskStatus int32
+
+const (
+	TaskPending TaskStatus = iota
+	TaskRunning
+	TaskDone
+	TaskFailed
+	TaskCancelled
+)
+
+func (s TaskStatus) String() string {
+	switch s {
+	case TaskPending:
+		return "pending"
+	case TaskRunning:
+		return "running"
+	case TaskDone:
+		return "done"
+	case TaskFailed:
+		return "failed"
+	case TaskCancelled:
+		return "cancelled"
+	}
+	return fmt.Sprintf("TaskStatus(%d)", int32(s))
+}
+
+var ErrTaskCancelled = errors.New("task cancelled")
+
+// PanicError is the error reported for a job which panicked.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("task panicked: %v", e.Value)
+}
+
+// Handle tracks a task added to a TimeWheel.
+//
+// A one-shot task ends up done, failed or cancelled. A recurring task goes back
+// to pending after each occurrence, with Err reporting the outcome of the latest
+// one, and only ends when it is cancelled.
+type Handle struct {
+	tw        *TimeWheel
+	key       string
+	recurring bool
+
+	mu      sync.Mutex
+	status  TaskStatus
+	running int
+	err     error
+	done    chan struct{}
+}
+
+func newHandle(tw *TimeWheel, key string, recurring bool) *Handle {
+	return &Handle{
+		tw:        tw,
+		key:       key,
+		recurring: recurring,
+		done:      make(chan struct{}),
+	}
+}
+
+func (h *Handle) Key() string {
+	return h.key
+}
+
+func (h *Handle) Status() TaskStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.status
+}
+
+// Err returns the error of the job, a *PanicError if it panicked,
+// ErrTaskCancelled if the task was cancelled, or ErrStopped if it was
+// added to a stopped wheel.
+func (h *Handle) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// Done is closed once the task reaches a final status.
+func (h *Handle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait blocks until the task reaches a final status and returns its error,
+// or returns ctx.Err() if ctx is done first.
+func (h *Handle) Wait(ctx context.Context) error {
+	select {
+	case <-h.done:
+		return h.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Cancel removes a pending task from the wheel, for a recurring task also
+// while an occurrence is running. It reports whether the task was cancelled.
+func (h *Handle) Cancel() bool {
+	if !h.cancel() {
+		return false
+	}
+	h.tw.cancelTask(h)
+	return true
+}
+
+func (h *Handle) cancel() bool {
+	return h.cancelWith(ErrTaskCancelled)
+}
+
+func (h *Handle) cancelWith(err error) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case h.status == TaskPending, h.status == TaskRunning && h.recurring:
+		h.status = TaskCancelled
+		h.err = err
+		close(h.done)
+		return true
+	}
+	return false
+}
+
+// fail reports an occurrence which never got to run.
+func (h *Handle) fail(err error) {
+	if err == ErrTaskCancelled {
+		h.cancel()
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.status != TaskPending && !(h.status == TaskRunning && h.recurring) {
+		return
+	}
+	h.err = err
+	if !h.recurring {
+		h.status = TaskFailed
+		close(h.done)
+	}
+}
+
+func (h *Handle) start() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.status != TaskPending && !(h.status == TaskRunning && h.recurring) {
+		return false
+	}
+	h.status = TaskRunning
+	h.running++
+	return true
+}
+
+func (h *Handle) finish(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running--
+	if h.status == TaskCancelled {
+		return
+	}
+	h.err = err
+	switch {
+	case h.recurring && h.running > 0:
+	case h.recurring:
+		h.status = TaskPending
+	case err != nil:
+		h.status = TaskFailed
+		close(h.done)
+	default:
+		h.status = TaskDone
+		close(h.done)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package timewheel
+
+import (
+	"errors"
+	"time"
+)
+
+// Event describes a task of a TimeWheel or an RTimeWheel to Hooks.
+type Event struct {
+	Key           string
+	ExecutionTime time.Time     // zero for the reclaimed tasks of an RTimeWheel
+	Lateness      time.Duration // of the firing compared to ExecutionTime, in OnFired
+	Duration      time.Duration // of the execution, in OnSucceeded, OnFailed and OnPanic
+	Err           error         // in OnFailed, and a *PanicError in OnPanic
+}
+
+// Hooks observe the tasks of a wheel. They are called synchronously, from the
+// loop of a TimeWheel for OnScheduled and OnFired, so they must not block.
+type Hooks interface {
+	// OnScheduled is called when a task is added, moved or retried, or the
+	// next occurrence of a recurring one is scheduled.
+	OnScheduled(e Event)
+	// OnFired is called when a task is due and about to be executed.
+	OnFired(e Event)
+	OnSucceeded(e Event)
+	// OnFailed is called when a task returns an error, or is dropped by the
+	// worker pool of a TimeWheel.
+	OnFailed(e Event)
+	// OnPanic is called instead of OnFailed when a task panics.
+	OnPanic(e Event)
+}
+
+// NopHooks ignore every event, embed them to implement part of Hooks.
+type NopHooks struct{}
+
+func (NopHooks) OnScheduled(Event) {}
+func (NopHooks) OnFired(Event)     {}
+func (NopHooks) OnSucceeded(Event) {}
+func (NopHooks) OnFailed(Event)    {}
+func (NopHooks) OnPanic(Event)     {}
+
+// multiHooks calls every hook in turn, none if empty.
+type multiHooks []Hooks
+
+func (m multiHooks) OnScheduled(e Event) {
+	for _, h := range m {
+		h.OnScheduled(e)
+	}
+}
+
+func (m multiHooks) OnFired(e Event) {
+	for _, h := range m {
+		h.OnFired(e)
+	}
+}
+
+func (m multiHooks) OnSucceeded(e Event) {
+	for _, h := range m {
+		h.OnSucceeded(e)
+	}
+}
+
+func (m multiHooks) OnFailed(e Event) {
+	for _, h := range m {
+		h.OnFailed(e)
+	}
+}
+
+func (m multiHooks) OnPanic(e Event) {
+	for _, h := range m {
+		h.OnPanic(e)
+	}
+}
+
+// finished reports the outcome of an execution by the type of err.
+func (m multiHooks) finished(e Event, err error) {
+	e.Err = err
+	var panicErr *PanicError
+	switch {
+	case err == nil:
+		m.OnSucceeded(e)
+	case errors.As(err, &panicErr):
+		m.OnPanic(e)
+	default:
+		m.OnFailed(e)
+	}
+}
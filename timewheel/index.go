@@ -0,0 +1,202 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package timewheel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/demdxx/gocast"
+)
+
+// RTaskStatus is the status of an RTask, kept by key for WithStatusTTL once
+// the task is over.
+type RTaskStatus string
+
+const (
+	RTaskScheduled RTaskStatus = "scheduled"
+	RTaskRunning   RTaskStatus = "running"
+	RTaskSucceeded RTaskStatus = "succeeded"
+	RTaskFailed    RTaskStatus = "failed" // out of retries, see GetDeadLetter
+	RTaskCancelled RTaskStatus = "cancelled"
+)
+
+// RTaskInfo describes the task of a key.
+type RTaskInfo struct {
+	Status    RTaskStatus
+	UpdatedAt time.Time
+	Error     string // of the last failed attempt
+	// Task and ExecutionTime are those of the pending task, nil and zero if none.
+	Task          *RTask
+	ExecutionTime time.Time
+}
+
+type indexEntry struct {
+	Slot   string `json:"slot"`
+	Score  int64  `json:"score"`
+	Member string `json:"member"`
+}
+
+type statusRecord struct {
+	Status    RTaskStatus `json:"status"`
+	UpdatedAt int64       `json:"updated_at"`
+	Error     string      `json:"error"`
+}
+
+// GetTask returns the task of a key, pending or whose status is still kept,
+// or ErrTaskNotFound.
+func (r *RTimeWheel) GetTask(ctx context.Context, key string) (*RTaskInfo, error) {
+	rawReply, err := r.redisClient.Eval(ctx, LuaGetTask, 1, []interface{}{
+		r.getIndexKey(),
+		key,
+		r.getStatusKeyPrefix(),
+		r.clock.Now().Unix(),
+		r.statusTTLSeconds(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	replies := gocast.ToInterfaceSlice(rawReply)
+	if len(replies) != 2 {
+		return nil, fmt.Errorf("invalid replies: %v", replies)
+	}
+	entry, status := gocast.ToString(replies[0]), gocast.ToString(replies[1])
+	if entry == "" && status == "" {
+		return nil, ErrTaskNotFound
+	}
+	info := RTaskInfo{Status: RTaskScheduled}
+	if status != "" {
+		var record statusRecord
+		if err := json.Unmarshal([]byte(status), &record); err != nil {
+			return nil, err
+		}
+		info.Status, info.UpdatedAt, info.Error = record.Status, time.Unix(record.UpdatedAt, 0), record.Error
+	}
+	if entry != "" {
+		var e indexEntry
+		if err := json.Unmarshal([]byte(entry), &e); err != nil {
+			return nil, err
+		}
+		var task RTask
+		if err := json.Unmarshal([]byte(e.Member), &task); err != nil {
+			return nil, err
+		}
+		info.Task, info.ExecutionTime = &task, time.Unix(e.Score, 0)
+	}
+	return &info, nil
+}
+
+// Reschedule moves the pending task key to executionTime, or returns ErrTaskNotFound.
+func (r *RTimeWheel) Reschedule(ctx context.Context, key string, executionTime time.Time) error {
+	if r.stopped() {
+		return ErrStopped
+	}
+	executionTime = r.nextExecutionTime(executionTime)
+	moved, err := r.redisClient.Eval(ctx, LuaRescheduleTask, 2, []interface{}{
+		r.getIndexKey(),
+		r.getMinuteSlice(executionTime),
+		key,
+		executionTime.Unix(),
+		r.getStatusKeyPrefix(),
+		r.clock.Now().Unix(),
+		r.slotRetentionSeconds(),
+	})
+	if err != nil {
+		return err
+	}
+	if gocast.ToInt(moved) == 0 {
+		return ErrTaskNotFound
+	}
+	r.hooks.OnScheduled(Event{Key: key, ExecutionTime: executionTime})
+	return nil
+}
+
+// MaxListRange bounds the time range of ListTasks.
+const MaxListRange = 24 * time.Hour
+
+// ListTasks returns up to limit pending tasks due from from to to, by execution time.
+func (r *RTimeWheel) ListTasks(ctx context.Context, from, to time.Time, limit int) ([]*RTaskInfo, error) {
+	if to.Before(from) || to.Sub(from) > MaxListRange {
+		return nil, fmt.Errorf("invalid range from %v to %v", from, to)
+	}
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid limit %d", limit)
+	}
+	var keys []interface{}
+	for minute := GetTimeSecond(from).Truncate(time.Minute); !minute.After(to); minute = minute.Add(time.Minute) {
+		keys = append(keys, r.getMinuteSlice(minute))
+	}
+	rawReply, err := r.redisClient.Eval(ctx, LuaListTasks, len(keys), append(keys, from.Unix(), to.Unix(), limit))
+	if err != nil {
+		return nil, err
+	}
+	replies := gocast.ToInterfaceSlice(rawReply)
+	infos := make([]*RTaskInfo, 0, len(replies)/2)
+	for i := 0; i+1 < len(replies); i += 2 {
+		var task RTask
+		if err := json.Unmarshal([]byte(gocast.ToString(replies[i])), &task); err != nil {
+			return nil, err
+		}
+		infos = append(infos, &RTaskInfo{
+			Status:        RTaskScheduled,
+			Task:          &task,
+			ExecutionTime: time.Unix(gocast.ToInt64(gocast.ToString(replies[i+1])), 0),
+		})
+	}
+	return infos, nil
+}
+
+// Len returns the number of pending tasks, occurrences of schedules included.
+// Tasks left in minute zsets beyond the max lookback are counted until polls
+// sweep them out of the index.
+func (r *RTimeWheel) Len(ctx context.Context) (int, error) {
+	return r.redisClient.HLen(ctx, r.getIndexKey())
+}
+
+// sweepIndexBatch is the number of index entries checked by every poll.
+const sweepIndexBatch = 100
+
+// sweepIndex drops the next entries of the index whose minute zset expired or
+// was skipped, marking their tasks cancelled.
+func (r *RTimeWheel) sweepIndex(ctx context.Context) error {
+	_, err := r.redisClient.Eval(ctx, LuaSweepIndex, 2, []interface{}{
+		r.getIndexKey(),
+		r.getIndexSweepCursorKey(),
+		sweepIndexBatch,
+		r.getStatusKeyPrefix(),
+		r.clock.Now().Unix(),
+		r.statusTTLSeconds(),
+	})
+	return err
+}
+
+func (r *RTimeWheel) statusTTLSeconds() int64 {
+	if ttl := int64(r.statusTTL / time.Second); ttl > 0 {
+		return ttl
+	}
+	return 1
+}
@@ -0,0 +1,137 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package timewheel
+
+import (
+	"sort"
+	"time"
+)
+
+// TaskInfo describes a pending task of a TimeWheel.
+type TaskInfo struct {
+	Key           string
+	ExecutionTime time.Time
+	// Cycles is the number of full rotations of the level-0 wheel left before the task is due.
+	Cycles    int
+	Recurring bool
+}
+
+func (t *TimeWheel) info(task *task) TaskInfo {
+	return TaskInfo{
+		Key:           task.key,
+		ExecutionTime: task.executionTime,
+		Cycles:        int((task.expiration - t.currentTick) / int64(t.slotsNum)),
+		Recurring:     task.schedule != nil,
+	}
+}
+
+// Len returns the number of pending tasks.
+func (t *TimeWheel) Len() int {
+	var n int
+	_ = t.inLoop(func() {
+		n = len(t.keyToElementMap)
+	})
+	return n
+}
+
+// Get returns the pending task of the given key.
+func (t *TimeWheel) Get(key string) (TaskInfo, bool) {
+	var info TaskInfo
+	var ok bool
+	_ = t.inLoop(func() {
+		if e, found := t.keyToElementMap[key]; found {
+			info, ok = t.info(e.Value.(*task)), true
+		}
+	})
+	return info, ok
+}
+
+// Tasks returns all the pending tasks in the order they are due.
+func (t *TimeWheel) Tasks() []TaskInfo {
+	var tasks []*task
+	var infos []TaskInfo
+	_ = t.inLoop(func() {
+		tasks = make([]*task, 0, len(t.keyToElementMap))
+		for _, element := range t.keyToElementMap {
+			tasks = append(tasks, element.Value.(*task))
+		}
+		sort.Slice(tasks, func(i, j int) bool {
+			return tasks[i].before(tasks[j])
+		})
+		infos = make([]TaskInfo, 0, len(tasks))
+		for _, task := range tasks {
+			infos = append(infos, t.info(task))
+		}
+	})
+	return infos
+}
+
+// Keys returns the keys of all the pending tasks in the order they are due.
+func (t *TimeWheel) Keys() []string {
+	tasks := t.Tasks()
+	keys := make([]string, 0, len(tasks))
+	for _, task := range tasks {
+		keys = append(keys, task.Key)
+	}
+	return keys
+}
+
+// Range calls fn for each pending task in the order they are due until fn returns false.
+// It iterates over a snapshot, so fn may call other methods of the wheel.
+func (t *TimeWheel) Range(fn func(info TaskInfo) bool) {
+	for _, info := range t.Tasks() {
+		if !fn(info) {
+			return
+		}
+	}
+}
+
+// NextDue returns the pending task which is due first.
+func (t *TimeWheel) NextDue() (TaskInfo, bool) {
+	var info TaskInfo
+	var ok bool
+	_ = t.inLoop(func() {
+		var first *task
+		for _, element := range t.keyToElementMap {
+			if task := element.Value.(*task); first == nil || task.before(first) {
+				first = task
+			}
+		}
+		if first != nil {
+			info, ok = t.info(first), true
+		}
+	})
+	return info, ok
+}
+
+func (t *task) before(other *task) bool {
+	if t.expiration != other.expiration {
+		return t.expiration < other.expiration
+	}
+	if !t.executionTime.Equal(other.executionTime) {
+		return t.executionTime.Before(other.executionTime)
+	}
+	return t.key < other.key
+}
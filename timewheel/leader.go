@@ -0,0 +1,80 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package timewheel
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/demdxx/gocast"
+)
+
+// IsLeader reports whether the RTimeWheel held the leadership at its last poll.
+// It is always false without WithLeaderElection.
+func (r *RTimeWheel) IsLeader() bool {
+	return r.fencingToken.Load() > 0
+}
+
+// elect acquires or renews the leadership and returns the fencing token as
+// passed to the claim scripts, "" if another node leads or r is stopped.
+func (r *RTimeWheel) elect(ctx context.Context) (string, error) {
+	// a stopped wheel must not take the leadership back after resigning
+	r.leaderMu.Lock()
+	defer r.leaderMu.Unlock()
+	if r.stopped() {
+		return "", nil
+	}
+	reply, err := r.redisClient.Eval(ctx, LuaAcquireLeader, 2, []interface{}{
+		r.getLeaderKey(),
+		r.getFencingTokenKey(),
+		r.leaderID,
+		r.leaderTTL.Milliseconds(),
+	})
+	if err != nil {
+		r.fencingToken.Store(0)
+		return "", err
+	}
+	token := gocast.ToInt64(reply)
+	r.fencingToken.Store(token)
+	if token == 0 {
+		return "", nil
+	}
+	return strconv.FormatInt(token, 10), nil
+}
+
+// resign gives up the leadership, if held, so that another node takes over
+// without waiting for it to expire.
+func (r *RTimeWheel) resign(ctx context.Context) error {
+	r.leaderMu.Lock()
+	defer r.leaderMu.Unlock()
+	if r.fencingToken.Swap(0) == 0 {
+		return nil
+	}
+	_, err := r.redisClient.Eval(ctx, LuaReleaseLeader, 1, []interface{}{
+		r.getLeaderKey(),
+		r.leaderID,
+	})
+	return err
+}
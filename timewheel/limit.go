@@ -0,0 +1,155 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package timewheel
+
+import (
+	"context"
+	"sync"
+)
+
+// limiter bounds the callbacks of an RTimeWheel running at once, overall and
+// per destination host, across polls. It also keeps the tasks claimed and not
+// done yet, running or waiting, whose leases are renewed on every poll.
+type limiter struct {
+	slots   chan struct{} // nil if unbounded
+	perHost int           // 0 if unbounded
+	mu      sync.Mutex
+	hosts   map[string]*hostSlots
+	held    map[string]int // claimed members of the in-flight zset, by count
+	holding int
+}
+
+type hostSlots struct {
+	slots chan struct{}
+	users int // tasks running or waiting, the entry is dropped at 0
+}
+
+func newLimiter(maxInFlight, maxPerHost int) *limiter {
+	l := &limiter{
+		perHost: maxPerHost,
+		hosts:   make(map[string]*hostSlots),
+		held:    make(map[string]int),
+	}
+	if maxInFlight > 0 {
+		l.slots = make(chan struct{}, maxInFlight)
+	}
+	return l
+}
+
+// free returns how many more tasks may be claimed, -1 if unbounded. Polling
+// should wait at 0.
+func (l *limiter) free() int {
+	if l.slots == nil {
+		return -1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.holding >= cap(l.slots) {
+		return 0
+	}
+	return cap(l.slots) - l.holding
+}
+
+func (l *limiter) hold(tasks []*RTask) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, task := range tasks {
+		l.held[task.claimed]++
+	}
+	l.holding += len(tasks)
+}
+
+func (l *limiter) done(task *RTask) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held[task.claimed]--; l.held[task.claimed] <= 0 {
+		delete(l.held, task.claimed)
+	}
+	l.holding--
+}
+
+// leased returns the claimed members of the tasks not done yet.
+func (l *limiter) leased() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	members := make([]string, 0, len(l.held))
+	for member := range l.held {
+		members = append(members, member)
+	}
+	return members
+}
+
+// acquire waits for a slot of the host, if any, then for an overall one, so
+// tasks waiting for a busy host hold no overall slot. The returned function
+// releases both.
+func (l *limiter) acquire(ctx context.Context, host string) (func(), error) {
+	var h *hostSlots
+	if l.perHost > 0 && host != "" {
+		l.mu.Lock()
+		h = l.hosts[host]
+		if h == nil {
+			h = &hostSlots{slots: make(chan struct{}, l.perHost)}
+			l.hosts[host] = h
+		}
+		h.users++
+		l.mu.Unlock()
+		select {
+		case h.slots <- struct{}{}:
+		case <-ctx.Done():
+			l.leave(host, h, false)
+			return nil, ctx.Err()
+		}
+	}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			if h != nil {
+				l.leave(host, h, true)
+			}
+			return nil, ctx.Err()
+		}
+	}
+	return func() {
+		if l.slots != nil {
+			<-l.slots
+		}
+		if h != nil {
+			l.leave(host, h, true)
+		}
+	}, nil
+}
+
+func (l *limiter) leave(host string, h *hostSlots, acquired bool) {
+	if acquired {
+		<-h.slots
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h.users--
+	if h.users == 0 {
+		delete(l.hosts, host)
+	}
+}
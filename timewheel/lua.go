@@ -24,44 +24,469 @@
 
 package timewheel
 
+// luaTaskIndex is prepended to the scripts maintaining the task index, which
+// maps the key of every pending task to its minute zset, score and member, the
+// status of tasks, and the expiration of minute zsets.
+const luaTaskIndex = `
+	local function set_status(status_key, status, at, err, ttl)
+		redis.call('set', status_key, cjson.encode({status = status, updated_at = tonumber(at), error = err}))
+		if ttl then
+			redis.call('expire', status_key, ttl)
+		end
+	end
+	local function index_task(index_key, task_key, slot, score, member)
+		redis.call('hset', index_key, task_key, cjson.encode({slot = slot, score = tonumber(score), member = member}))
+	end
+	local function unindex_task(index_key, task_key, member)
+		local entry = redis.call('hget', index_key, task_key)
+		if entry and cjson.decode(entry)['member'] == member then
+			redis.call('hdel', index_key, task_key)
+		end
+	end
+	local function expire_slot(zset_key, score, now, retention)
+		local ttl = tonumber(score) - tonumber(now) + tonumber(retention)
+		if redis.call('ttl', zset_key) < ttl then
+			redis.call('expire', zset_key, ttl)
+		end
+	end
+	local function remove_task(index_key, task_key)
+		local entry = redis.call('hget', index_key, task_key)
+		if not entry then
+			return nil
+		end
+		entry = cjson.decode(entry)
+		redis.call('zrem', entry['slot'], entry['member'])
+		redis.call('hdel', index_key, task_key)
+		return entry
+	end
+	-- drop_stale unindexes a task whose minute zset expired or was skipped, and
+	-- reports whether it did.
+	local function drop_stale(index_key, task_key, entry, status_prefix, now, ttl)
+		entry = cjson.decode(entry)
+		if redis.call('zscore', entry['slot'], entry['member']) then
+			return false
+		end
+		redis.call('hdel', index_key, task_key)
+		set_status(status_prefix .. task_key, 'cancelled', now, 'expired beyond the max lookback', ttl)
+		return true
+	end
+`
+
 const (
-	// If the pending task is in delete set, delete it.
-	// Then add it by score.
-	LuaAddTask = `
+	// Replace the pending task of the same key if any, then add it by score.
+	LuaAddTask = luaTaskIndex + `
 		local zset_key = KEYS[1]
-		local delete_set_key = KEYS[2]
+		local index_key = KEYS[2]
 		local score = ARGV[1]
 		local task = ARGV[2]
 		local task_key = ARGV[3]
-		redis.call('srem', delete_set_key, task_key)
-		return redis.call('zadd', zset_key, score, task)
+		local status_prefix = ARGV[4]
+		local now = ARGV[5]
+		local retention = ARGV[6]
+		remove_task(index_key, task_key)
+		index_task(index_key, task_key, zset_key, score, task)
+		set_status(status_prefix .. task_key, 'scheduled', now)
+		local added = redis.call('zadd', zset_key, score, task)
+		expire_slot(zset_key, score, now, retention)
+		return added
+	`
+
+	LuaRemoveTask = luaTaskIndex + `
+		local index_key = KEYS[1]
+		local task_key = ARGV[1]
+		local status_prefix = ARGV[2]
+		local now = ARGV[3]
+		local ttl = ARGV[4]
+		if not remove_task(index_key, task_key) then
+			return 0
+		end
+		set_status(status_prefix .. task_key, 'cancelled', now, nil, ttl)
+		return 1
 	`
 
-	LuaDeleteTask = `
-		local delete_set_key = KEYS[1]
+	LuaRescheduleTask = luaTaskIndex + `
+		local index_key = KEYS[1]
+		local zset_key = KEYS[2]
 		local task_key = ARGV[1]
-		redis.call('sadd', delete_set_key, task_key)
-		local scnt = redis.call('scard', delete_set_key)
-		if (tonumber(scnt) == 1)
-		then
-			redis.call('expire', delete_set_key, 120)
+		local score = ARGV[2]
+		local status_prefix = ARGV[3]
+		local now = ARGV[4]
+		local retention = ARGV[5]
+		local entry = remove_task(index_key, task_key)
+		if not entry then
+			return 0
 		end
-		return scnt
+		index_task(index_key, task_key, zset_key, score, entry['member'])
+		set_status(status_prefix .. task_key, 'scheduled', now)
+		redis.call('zadd', zset_key, score, entry['member'])
+		expire_slot(zset_key, score, now, retention)
+		return 1
 	`
 
-	LuaZRangeTasks = `
+	LuaGetTask = luaTaskIndex + `
+		local index_key = KEYS[1]
+		local task_key = ARGV[1]
+		local status_prefix = ARGV[2]
+		local now = ARGV[3]
+		local ttl = ARGV[4]
+		local entry = redis.call('hget', index_key, task_key)
+		if entry and drop_stale(index_key, task_key, entry, status_prefix, now, ttl) then
+			entry = nil
+		end
+		return {entry or '', redis.call('get', status_prefix .. task_key) or ''}
+	`
+
+	// Drop the stale entries among the next ARGV[1] ones of the index, going
+	// through it across calls from the cursor kept in KEYS[2].
+	LuaSweepIndex = luaTaskIndex + `
+		local index_key = KEYS[1]
+		local cursor_key = KEYS[2]
+		local count = ARGV[1]
+		local status_prefix = ARGV[2]
+		local now = ARGV[3]
+		local ttl = ARGV[4]
+		local scan = redis.call('hscan', index_key, redis.call('get', cursor_key) or '0', 'count', count)
+		local dropped = 0
+		for i = 1, #scan[2], 2 do
+			if drop_stale(index_key, scan[2][i], scan[2][i + 1], status_prefix, now, ttl) then
+				dropped = dropped + 1
+			end
+		end
+		redis.call('set', cursor_key, scan[1])
+		return dropped
+	`
+
+	// Return the tasks of the minute zsets due from ARGV[1] to ARGV[2], with
+	// their scores, up to ARGV[3] of them.
+	LuaListTasks = `
+		local from = ARGV[1]
+		local to = ARGV[2]
+		local limit = tonumber(ARGV[3])
+		local reply = {}
+		for i, zset_key in ipairs(KEYS) do
+			local tasks = redis.call('zrange', zset_key, from, to, 'byscore', 'withscores', 'limit', 0, limit - #reply / 2)
+			for j, v in ipairs(tasks) do
+				reply[#reply+1] = v
+			end
+			if #reply / 2 >= limit then
+				break
+			end
+		end
+		return reply
+	`
+
+	// Return the tasks due up to score with their scores, at most limit unless
+	// it is negative.
+	LuaPeekTasks = `
+		local zset_key = KEYS[1]
+		local score = ARGV[1]
+		local limit = ARGV[2]
+		return redis.call('zrange', zset_key, '-inf', score, 'byscore', 'withscores', 'limit', 0, limit)
+	`
+
+	// Move the peeked tasks which are still there and, for the occurrences of a
+	// schedule, of its current generation and not paused, to the in-flight zset,
+	// scored by their lease deadline, and enqueue the successors of these
+	// occurrences. Then raise the high-water mark.
+	// ARGV holds a (task, successor score, successor) triple per peeked task, and
+	// KEYS the minute zset of each successor after the fixed ones.
+	LuaClaimTasks = luaTaskIndex + `
 		local zset_key = KEYS[1]
-		local delete_set_key = KEYS[2]
-		local score1 = ARGV[1]
-		local score2 = ARGV[2]
-		local delete_set = redis.call('smembers', delete_set_key)
-		local targets = redis.call('zrange', zset_key, score1, score2, 'byscore')
-		redis.call('zremrangebyscore', zset_key, score1, score2)
+		local inflight_key = KEYS[2]
+		local hwm_key = KEYS[3]
+		local fencing_token_key = KEYS[4]
+		local schedules_key = KEYS[5]
+		local schedule_next_key = KEYS[6]
+		local index_key = KEYS[7]
+		local score = ARGV[1]
+		local deadline = ARGV[2]
+		local fencing_token = ARGV[3]
+		local status_prefix = ARGV[4]
+		local now = ARGV[5]
+		local ttl = ARGV[6]
+		local retention = ARGV[7]
+		if fencing_token ~= '' and redis.call('get', fencing_token_key) ~= fencing_token then
+			return redis.error_reply('stale fencing token')
+		end
 		local reply = {}
-		reply[1] = delete_set
-		for i, v in ipairs(targets) do
-			reply[#reply+1] = v
+		for i = 1, (#ARGV - 7) / 3 do
+			local v = ARGV[3 * i + 5]
+			local successor_score = ARGV[3 * i + 6]
+			local successor = ARGV[3 * i + 7]
+			if redis.call('zrem', zset_key, v) == 1 then
+				local task = cjson.decode(v)
+				unindex_task(index_key, task['key'], v)
+				local live = true
+				if task['schedule'] then
+					local schedule = redis.call('hget', schedules_key, task['key'])
+					if schedule then
+						schedule = cjson.decode(schedule)
+						live = schedule['generation'] == task['generation'] and not schedule['paused']
+					else
+						live = false
+					end
+				end
+				if live then
+					redis.call('zadd', inflight_key, deadline, v)
+					set_status(status_prefix .. task['key'], 'running', now)
+					reply[#reply+1] = v
+					if successor ~= '' then
+						redis.call('zadd', KEYS[7 + i], successor_score, successor)
+						expire_slot(KEYS[7 + i], successor_score, now, retention)
+						index_task(index_key, task['key'], KEYS[7 + i], successor_score, successor)
+						redis.call('hset', schedule_next_key, task['key'], successor_score)
+					end
+				else
+					set_status(status_prefix .. task['key'], 'cancelled', now, nil, ttl)
+				end
+			end
+		end
+		local hwm = redis.call('get', hwm_key)
+		if not hwm or tonumber(hwm) < tonumber(score) then
+			redis.call('set', hwm_key, score)
 		end
 		return reply
 	`
+
+	// Extend up to limit expired leases, all of them if negative, and return
+	// their tasks.
+	LuaReclaimTasks = `
+		local inflight_key = KEYS[1]
+		local fencing_token_key = KEYS[2]
+		local now = ARGV[1]
+		local deadline = ARGV[2]
+		local fencing_token = ARGV[3]
+		local limit = ARGV[4]
+		if fencing_token ~= '' and redis.call('get', fencing_token_key) ~= fencing_token then
+			return redis.error_reply('stale fencing token')
+		end
+		local expired = redis.call('zrangebyscore', inflight_key, '-inf', now, 'limit', 0, limit)
+		for i, v in ipairs(expired) do
+			redis.call('zadd', inflight_key, deadline, v)
+		end
+		return expired
+	`
+
+	// Extend the leases of the given tasks still in flight.
+	LuaRenewLeases = `
+		local inflight_key = KEYS[1]
+		local deadline = ARGV[1]
+		for i = 2, #ARGV do
+			redis.call('zadd', inflight_key, 'xx', deadline, ARGV[i])
+		end
+		return #ARGV - 1
+	`
+
+	// Renew the leadership if held, else try to take it with a new fencing token.
+	// Return the fencing token, 0 if another node leads.
+	LuaAcquireLeader = `
+		local leader_key = KEYS[1]
+		local fencing_token_key = KEYS[2]
+		local id = ARGV[1]
+		local ttl = ARGV[2]
+		if redis.call('get', leader_key) == id then
+			redis.call('pexpire', leader_key, ttl)
+			return tonumber(redis.call('get', fencing_token_key))
+		end
+		if not redis.call('set', leader_key, id, 'nx', 'px', ttl) then
+			return 0
+		end
+		return redis.call('incr', fencing_token_key)
+	`
+
+	LuaReleaseLeader = `
+		local leader_key = KEYS[1]
+		local id = ARGV[1]
+		if redis.call('get', leader_key) == id then
+			return redis.call('del', leader_key)
+		end
+		return 0
+	`
+
+	LuaAckTask = luaTaskIndex + `
+		local inflight_key = KEYS[1]
+		local task = ARGV[1]
+		local task_key = ARGV[2]
+		local status_prefix = ARGV[3]
+		local now = ARGV[4]
+		local ttl = ARGV[5]
+		if redis.call('zrem', inflight_key, task) == 0 then
+			return 0
+		end
+		set_status(status_prefix .. task_key, 'succeeded', now, nil, ttl)
+		return 1
+	`
+
+	// Release the lease of a failed task and enqueue its next attempt, unless a
+	// new task of the same key, other than the successor of a schedule occurrence,
+	// was added meanwhile, when -1 is returned.
+	LuaRetryTask = luaTaskIndex + `
+		local inflight_key = KEYS[1]
+		local zset_key = KEYS[2]
+		local index_key = KEYS[3]
+		local claimed = ARGV[1]
+		local score = ARGV[2]
+		local task = ARGV[3]
+		local task_key = ARGV[4]
+		local status_prefix = ARGV[5]
+		local now = ARGV[6]
+		local err = ARGV[7]
+		local retention = ARGV[8]
+		local generation = ARGV[9]
+		redis.call('zrem', inflight_key, claimed)
+		local entry = redis.call('hget', index_key, task_key)
+		local member = entry and cjson.decode(entry)['member']
+		if member and generation ~= '' and cjson.decode(member)['generation'] == generation then
+			-- the index holds the successor of this occurrence, which stays indexed
+		elseif member and member ~= claimed then
+			-- a new task of the key was added meanwhile, it supersedes this one
+			return -1
+		else
+			index_task(index_key, task_key, zset_key, score, task)
+		end
+		set_status(status_prefix .. task_key, 'scheduled', now, err)
+		local added = redis.call('zadd', zset_key, score, task)
+		expire_slot(zset_key, score, now, retention)
+		return added
+	`
+
+	// Save a schedule unless it was changed since read as expected, '' for any,
+	// and enqueue its next occurrence if any, in place of the pending one.
+	LuaSaveSchedule = luaTaskIndex + `
+		local schedules_key = KEYS[1]
+		local schedule_next_key = KEYS[2]
+		local zset_key = KEYS[3]
+		local index_key = KEYS[4]
+		local schedule_key = ARGV[1]
+		local expected = ARGV[2]
+		local schedule = ARGV[3]
+		local score = ARGV[4]
+		local task = ARGV[5]
+		local status_prefix = ARGV[6]
+		local now = ARGV[7]
+		local retention = ARGV[8]
+		if expected ~= '' and redis.call('hget', schedules_key, schedule_key) ~= expected then
+			return 0
+		end
+		redis.call('hset', schedules_key, schedule_key, schedule)
+		if score == '' then
+			redis.call('hdel', schedule_next_key, schedule_key)
+			return 1
+		end
+		remove_task(index_key, schedule_key)
+		redis.call('hset', schedule_next_key, schedule_key, score)
+		index_task(index_key, schedule_key, zset_key, score, task)
+		set_status(status_prefix .. schedule_key, 'scheduled', now)
+		redis.call('zadd', zset_key, score, task)
+		expire_slot(zset_key, score, now, retention)
+		return 1
+	`
+
+	LuaGetSchedule = `
+		local schedules_key = KEYS[1]
+		local schedule_next_key = KEYS[2]
+		local schedule_key = ARGV[1]
+		return {redis.call('hget', schedules_key, schedule_key), redis.call('hget', schedule_next_key, schedule_key)}
+	`
+
+	LuaListSchedules = `
+		local schedules_key = KEYS[1]
+		local schedule_next_key = KEYS[2]
+		return {redis.call('hgetall', schedules_key), redis.call('hgetall', schedule_next_key)}
+	`
+
+	// Delete a schedule along with its pending occurrence.
+	LuaDeleteSchedule = luaTaskIndex + `
+		local schedules_key = KEYS[1]
+		local schedule_next_key = KEYS[2]
+		local index_key = KEYS[3]
+		local schedule_key = ARGV[1]
+		local status_prefix = ARGV[2]
+		local now = ARGV[3]
+		local ttl = ARGV[4]
+		if redis.call('hdel', schedules_key, schedule_key) == 0 then
+			return 0
+		end
+		redis.call('hdel', schedule_next_key, schedule_key)
+		local entry = redis.call('hget', index_key, schedule_key)
+		if entry and cjson.decode(cjson.decode(entry)['member'])['schedule'] then
+			remove_task(index_key, schedule_key)
+			set_status(status_prefix .. schedule_key, 'cancelled', now, nil, ttl)
+		end
+		return 1
+	`
+
+	// Release the lease of a failed task and keep it as a dead letter.
+	LuaAddDeadLetter = luaTaskIndex + `
+		local letters_key = KEYS[1]
+		local letters_index_key = KEYS[2]
+		local inflight_key = KEYS[3]
+		local task_key = ARGV[1]
+		local letter = ARGV[2]
+		local failed_at = ARGV[3]
+		local claimed = ARGV[4]
+		local status_prefix = ARGV[5]
+		local err = ARGV[6]
+		local ttl = ARGV[7]
+		redis.call('zrem', inflight_key, claimed)
+		set_status(status_prefix .. task_key, 'failed', failed_at, err, ttl)
+		redis.call('hset', letters_key, task_key, letter)
+		return redis.call('zadd', letters_index_key, failed_at, task_key)
+	`
+
+	LuaGetDeadLetter = `
+		local letters_key = KEYS[1]
+		local task_key = ARGV[1]
+		return redis.call('hget', letters_key, task_key)
+	`
+
+	LuaListDeadLetters = `
+		local letters_key = KEYS[1]
+		local letters_index_key = KEYS[2]
+		local start = ARGV[1]
+		local stop = ARGV[2]
+		local task_keys = redis.call('zrevrange', letters_index_key, start, stop)
+		if #task_keys == 0 then
+			return {}
+		end
+		return redis.call('hmget', letters_key, unpack(task_keys))
+	`
+
+	// Only replay the dead letter we read, if it was not replaced meanwhile.
+	LuaReplayDeadLetter = luaTaskIndex + `
+		local letters_key = KEYS[1]
+		local letters_index_key = KEYS[2]
+		local zset_key = KEYS[3]
+		local index_key = KEYS[4]
+		local task_key = ARGV[1]
+		local letter = ARGV[2]
+		local score = ARGV[3]
+		local task = ARGV[4]
+		local status_prefix = ARGV[5]
+		local now = ARGV[6]
+		local retention = ARGV[7]
+		if redis.call('hget', letters_key, task_key) ~= letter then
+			return 0
+		end
+		redis.call('hdel', letters_key, task_key)
+		redis.call('zrem', letters_index_key, task_key)
+		remove_task(index_key, task_key)
+		index_task(index_key, task_key, zset_key, score, task)
+		set_status(status_prefix .. task_key, 'scheduled', now)
+		redis.call('zadd', zset_key, score, task)
+		expire_slot(zset_key, score, now, retention)
+		return 1
+	`
+
+	LuaPurgeDeadLetters = `
+		local letters_key = KEYS[1]
+		local letters_index_key = KEYS[2]
+		if #ARGV == 0 then
+			local cnt = redis.call('hlen', letters_key)
+			redis.call('del', letters_key, letters_index_key)
+			return cnt
+		end
+		redis.call('zrem', letters_index_key, unpack(ARGV))
+		return redis.call('hdel', letters_key, unpack(ARGV))
+	`
 )
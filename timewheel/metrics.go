@@ -0,0 +1,137 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package timewheel
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics are Hooks counting the tasks of a wheel, and an http.Handler serving
+// these counts in the Prometheus text format, e.g. on /metrics:
+//
+//	metrics := NewMetrics()
+//	tw := NewTimeWheel(10, time.Second, WithHooks(metrics))
+//	metrics.SetPending(func(context.Context) (int, error) { return tw.Len(), nil })
+//	http.Handle("/metrics", metrics)
+type Metrics struct {
+	scheduled atomic.Uint64
+	fired     atomic.Uint64
+	succeeded atomic.Uint64
+	failed    atomic.Uint64
+	panicked  atomic.Uint64
+	lateness  *Histogram
+	duration  *Histogram
+	mu        sync.RWMutex
+	pending   func(ctx context.Context) (int, error)
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		lateness: NewHistogram(),
+		duration: NewHistogram(),
+	}
+}
+
+// SetPending sets the function reporting the pending tasks, e.g. TimeWheel.Len
+// or RTimeWheel.Len, no gauge is exported without it.
+func (m *Metrics) SetPending(pending func(ctx context.Context) (int, error)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending = pending
+}
+
+func (m *Metrics) OnScheduled(Event) {
+	m.scheduled.Add(1)
+}
+
+func (m *Metrics) OnFired(e Event) {
+	m.fired.Add(1)
+	m.lateness.Observe(e.Lateness)
+}
+
+func (m *Metrics) OnSucceeded(e Event) {
+	m.succeeded.Add(1)
+	m.duration.Observe(e.Duration)
+}
+
+func (m *Metrics) OnFailed(e Event) {
+	m.failed.Add(1)
+	m.duration.Observe(e.Duration)
+}
+
+func (m *Metrics) OnPanic(e Event) {
+	m.panicked.Add(1)
+	m.duration.Observe(e.Duration)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	b := bufio.NewWriter(w)
+	defer b.Flush()
+
+	writeHeader(b, "timewheel_tasks_scheduled_total", "counter", "Tasks scheduled, including moved, retried and recurring ones.")
+	fmt.Fprintf(b, "timewheel_tasks_scheduled_total %d\n", m.scheduled.Load())
+	writeHeader(b, "timewheel_tasks_fired_total", "counter", "Tasks fired.")
+	fmt.Fprintf(b, "timewheel_tasks_fired_total %d\n", m.fired.Load())
+	writeHeader(b, "timewheel_tasks_finished_total", "counter", "Tasks executed, by outcome.")
+	fmt.Fprintf(b, "timewheel_tasks_finished_total{outcome=\"succeeded\"} %d\n", m.succeeded.Load())
+	fmt.Fprintf(b, "timewheel_tasks_finished_total{outcome=\"failed\"} %d\n", m.failed.Load())
+	fmt.Fprintf(b, "timewheel_tasks_finished_total{outcome=\"panicked\"} %d\n", m.panicked.Load())
+
+	m.mu.RLock()
+	pending := m.pending
+	m.mu.RUnlock()
+	if pending != nil {
+		if n, err := pending(r.Context()); err == nil {
+			writeHeader(b, "timewheel_tasks_pending", "gauge", "Tasks pending.")
+			fmt.Fprintf(b, "timewheel_tasks_pending %d\n", n)
+		}
+	}
+
+	writeHistogram(b, "timewheel_task_lateness_seconds", "How late tasks fired compared to their execution time.", m.lateness.Snapshot())
+	writeHistogram(b, "timewheel_task_duration_seconds", "How long tasks took to execute.", m.duration.Snapshot())
+}
+
+func writeHeader(b *bufio.Writer, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeHistogram(b *bufio.Writer, name, help string, s HistogramSnapshot) {
+	writeHeader(b, name, "histogram", help)
+	var cumulative uint64
+	for i, bound := range s.Bounds {
+		cumulative += s.Counts[i]
+		fmt.Fprintf(b, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound.Seconds(), 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", name, s.Count)
+	fmt.Fprintf(b, "%s_sum %s\n", name, strconv.FormatFloat(s.Sum.Seconds(), 'g', -1, 64))
+	fmt.Fprintf(b, "%s_count %d\n", name, s.Count)
+}
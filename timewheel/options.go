@@ -0,0 +1,205 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package timewheel
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Nicknamezz00/timewheel/pkg/signature"
+)
+
+type Options struct {
+	clock           Clock
+	poolWorkers     int
+	poolQueueSize   int
+	poolPolicy      OverflowPolicy
+	onReject        func(key string)
+	lease           time.Duration
+	maxLookback     time.Duration
+	leaderID        string
+	leaderTTL       time.Duration
+	signingKeys     []signature.Key
+	statusTTL       time.Duration
+	pollInterval    time.Duration
+	namespace       string
+	callbackTimeout time.Duration
+	maxInFlight     int
+	maxPerHost      int
+	hooks           multiHooks
+}
+
+type Option func(o *Options)
+
+// WithClock sets the clock of a TimeWheel or an RTimeWheel, e.g. a FakeClock in tests.
+func WithClock(clock Clock) Option {
+	return func(o *Options) {
+		o.clock = clock
+	}
+}
+
+// WithWorkerPool makes a TimeWheel run due tasks on a pool of workers with a
+// queue of queueSize tasks instead of a goroutine per task. Firings of the same
+// key never run concurrently on the pool.
+func WithWorkerPool(workers, queueSize int, policy OverflowPolicy) Option {
+	return func(o *Options) {
+		o.poolWorkers = workers
+		o.poolQueueSize = queueSize
+		o.poolPolicy = policy
+	}
+}
+
+// WithRejectHandler sets the function called with the key of every task
+// rejected by the worker pool under OverflowReject.
+func WithRejectHandler(onReject func(key string)) Option {
+	return func(o *Options) {
+		o.onReject = onReject
+	}
+}
+
+// WithLease sets how long an RTimeWheel node holds a claimed task before any
+// node may execute it again. Nodes renew the leases of their tasks on every
+// poll, so it bounds how long the tasks of a dead node wait, and the timeouts
+// of callbacks.
+func WithLease(lease time.Duration) Option {
+	return func(o *Options) {
+		o.lease = lease
+	}
+}
+
+// WithMaxLookback bounds how far back an RTimeWheel looks for tasks missed while
+// no node was polling, tasks due before are left in Redis.
+func WithMaxLookback(maxLookback time.Duration) Option {
+	return func(o *Options) {
+		o.maxLookback = maxLookback
+	}
+}
+
+// WithLeaderElection makes only one of the RTimeWheel nodes sharing a Redis
+// poll it: the one holding the leadership, which is taken under the given
+// unique id and lost ttl after the last renewal, i.e. the last poll.
+func WithLeaderElection(id string, ttl time.Duration) Option {
+	return func(o *Options) {
+		o.leaderID = id
+		o.leaderTTL = ttl
+	}
+}
+
+// WithSigningKeys makes an RTimeWheel sign its callbacks with each of the keys,
+// see package signature for verifying them.
+func WithSigningKeys(keys ...signature.Key) Option {
+	return func(o *Options) {
+		o.signingKeys = keys
+	}
+}
+
+// WithStatusTTL sets how long an RTimeWheel keeps the status of a task once
+// it succeeded, failed or was cancelled.
+func WithStatusTTL(ttl time.Duration) Option {
+	return func(o *Options) {
+		o.statusTTL = ttl
+	}
+}
+
+// WithPollInterval sets how often an RTimeWheel polls Redis for due tasks,
+// every second by default.
+func WithPollInterval(interval time.Duration) Option {
+	return func(o *Options) {
+		o.pollInterval = interval
+	}
+}
+
+// WithNamespace sets the namespace of the Redis keys of an RTimeWheel, so that
+// independent wheels can share a Redis. It is "timewheel" by default. As it is
+// the hash tag of the keys, braces are dropped from it.
+func WithNamespace(namespace string) Option {
+	return func(o *Options) {
+		o.namespace = namespace
+	}
+}
+
+// WithCallbackTimeout sets the timeout of the callbacks of an RTimeWheel whose
+// RTask has none, 30s by default or the lease if shorter.
+func WithCallbackTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.callbackTimeout = timeout
+	}
+}
+
+// WithMaxInFlight bounds the callbacks an RTimeWheel runs at once across polls,
+// no bound by default. No more tasks than free slots are claimed.
+func WithMaxInFlight(n int) Option {
+	return func(o *Options) {
+		o.maxInFlight = n
+	}
+}
+
+// WithMaxPerHost bounds the HTTP callbacks an RTimeWheel sends to the same host
+// at once, no bound by default, so a slow host does not hold every slot of
+// WithMaxInFlight.
+func WithMaxPerHost(n int) Option {
+	return func(o *Options) {
+		o.maxPerHost = n
+	}
+}
+
+// WithHooks makes a TimeWheel or an RTimeWheel report the events of its tasks
+// to the hooks, e.g. Metrics.
+func WithHooks(hooks ...Hooks) Option {
+	return func(o *Options) {
+		o.hooks = append(o.hooks, hooks...)
+	}
+}
+
+func legitimizeOptions(o *Options) {
+	if o.clock == nil {
+		o.clock = realClock{}
+	}
+	if o.lease <= 0 {
+		o.lease = time.Minute
+	}
+	if o.maxLookback <= 0 {
+		o.maxLookback = time.Hour
+	}
+	if o.leaderTTL <= 0 {
+		o.leaderTTL = 10 * time.Second
+	}
+	if o.statusTTL <= 0 {
+		o.statusTTL = 24 * time.Hour
+	}
+	if o.pollInterval <= 0 {
+		o.pollInterval = time.Second
+	}
+	o.namespace = strings.NewReplacer("{", "", "}", "").Replace(o.namespace)
+	if o.namespace == "" {
+		o.namespace = "timewheel"
+	}
+	if o.callbackTimeout <= 0 {
+		o.callbackTimeout = 30 * time.Second
+	}
+	if o.callbackTimeout > o.lease {
+		o.callbackTimeout = o.lease
+	}
+}
@@ -0,0 +1,178 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package timewheel
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	http2 "github.com/Nicknamezz00/timewheel/pkg/http"
+)
+
+const (
+	BodyEncodingText   = "text"
+	BodyEncodingBase64 = "base64"
+)
+
+var callbackMethods = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+func (t *RTask) checkBody() error {
+	bodies := 0
+	for _, set := range []bool{t.Req != nil, t.Form != nil, t.Body != ""} {
+		if set {
+			bodies++
+		}
+	}
+	if bodies > 1 {
+		return fmt.Errorf("more than one of req, form and body are set")
+	}
+	switch t.BodyEncoding {
+	case "", BodyEncodingText:
+	case BodyEncodingBase64:
+		if _, err := base64.StdEncoding.DecodeString(t.Body); err != nil {
+			return fmt.Errorf("invalid base64 body: %w", err)
+		}
+	default:
+		return fmt.Errorf("invalid body encoding: %s", t.BodyEncoding)
+	}
+	return nil
+}
+
+func (t *RTask) checkCallback() error {
+	if !callbackMethods[t.Method] {
+		return fmt.Errorf("invalid method: %s", t.Method)
+	}
+	if !strings.HasPrefix(t.CallbackURL, "http://") && !strings.HasPrefix(t.CallbackURL, "https://") {
+		return fmt.Errorf("invalid url: %s", t.CallbackURL)
+	}
+	for _, pattern := range t.ExpectedStatus {
+		if !validStatusPattern(pattern) {
+			return fmt.Errorf("invalid expected status: %s", pattern)
+		}
+	}
+	return t.checkBody()
+}
+
+// payload returns the body of the callback, nil for none, and its content type.
+func (t *RTask) payload() ([]byte, string, error) {
+	var body []byte
+	var contentType string
+	switch {
+	case t.Req != nil:
+		b, err := json.Marshal(t.Req)
+		if err != nil {
+			return nil, "", err
+		}
+		body, contentType = b, "application/json"
+	case t.Form != nil:
+		values := url.Values{}
+		for k, v := range t.Form {
+			values.Set(k, v)
+		}
+		body, contentType = []byte(values.Encode()), "application/x-www-form-urlencoded"
+	case t.BodyEncoding == BodyEncodingBase64:
+		b, err := base64.StdEncoding.DecodeString(t.Body)
+		if err != nil {
+			return nil, "", err
+		}
+		body, contentType = b, "application/octet-stream"
+	case t.Body != "":
+		body, contentType = []byte(t.Body), "text/plain; charset=utf-8"
+	}
+	if t.ContentType != "" {
+		contentType = t.ContentType
+	}
+	return body, contentType, nil
+}
+
+// url returns the callback URL with the query parameters of the task added.
+func (t *RTask) url() (string, error) {
+	if len(t.Query) == 0 {
+		return t.CallbackURL, nil
+	}
+	u, err := url.Parse(t.CallbackURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	for k, v := range t.Query {
+		query.Set(k, v)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// host returns the host the callback of an HTTP task is sent to, "" for other
+// types or an invalid URL.
+func (t *RTask) host() string {
+	if t.Type != "" && t.Type != ExecutorHTTP {
+		return ""
+	}
+	u, err := url.Parse(t.CallbackURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// checkStatus returns a StatusError unless the status code is expected,
+// 200 only if the task expects none in particular.
+func (t *RTask) checkStatus(statusCode int) error {
+	if len(t.ExpectedStatus) == 0 {
+		if statusCode == http.StatusOK {
+			return nil
+		}
+		return &http2.StatusError{StatusCode: statusCode}
+	}
+	code := strconv.Itoa(statusCode)
+	for _, pattern := range t.ExpectedStatus {
+		if pattern == code || strings.HasSuffix(pattern, "xx") && pattern[0] == code[0] {
+			return nil
+		}
+	}
+	return &http2.StatusError{StatusCode: statusCode}
+}
+
+// validStatusPattern accepts a status code such as "202", or a class such as "2xx".
+func validStatusPattern(pattern string) bool {
+	if len(pattern) != 3 || pattern[0] < '1' || pattern[0] > '5' {
+		return false
+	}
+	if pattern[1:] == "xx" {
+		return true
+	}
+	return pattern[1] >= '0' && pattern[1] <= '9' && pattern[2] >= '0' && pattern[2] <= '9'
+}
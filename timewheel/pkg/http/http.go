@@ -34,6 +34,15 @@ import (
 	"net/url"
 )
 
+// StatusError is returned for a response with an unexpected status code.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("invalid status: %d", e.StatusCode)
+}
+
 type Client struct {
 	core *http.Client
 }
@@ -62,22 +71,16 @@ func (c *Client) JSONDo(ctx context.Context, method, url string, header map[stri
 	if err != nil {
 		return err
 	}
-	if request.Header == nil {
-		request.Header = make(http.Header)
-	}
 	for k, v := range header {
 		request.Header.Add(k, v)
 	}
 	request.Header.Add("Content-Type", "application/json")
-	response, err := c.core.Do(request)
+	response, err := c.do(request)
 	if err != nil {
 		return err
 	}
 
 	defer response.Body.Close()
-	if response.StatusCode != http.StatusOK {
-		return fmt.Errorf("invalid status: %d", response.StatusCode)
-	}
 	if resp == nil {
 		return nil
 	}
@@ -88,6 +91,41 @@ func (c *Client) JSONDo(ctx context.Context, method, url string, header map[stri
 	return json.Unmarshal(responseBody, resp)
 }
 
+// Do sends body as is, nil for none, and returns the status code whatever it is,
+// discarding the response body.
+func (c *Client) Do(ctx context.Context, method, url string, header map[string]string, body []byte) (int, error) {
+	var reqReader io.Reader
+	if body != nil {
+		reqReader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, url, reqReader)
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range header {
+		request.Header.Set(k, v)
+	}
+	response, err := c.core.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, response.Body)
+	return response.StatusCode, nil
+}
+
+func (c *Client) do(request *http.Request) (*http.Response, error) {
+	response, err := c.core.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, &StatusError{StatusCode: response.StatusCode}
+	}
+	return response, nil
+}
+
 func getCompleteURL(original string, params map[string]string) string {
 	if len(params) == 0 {
 		return original
@@ -26,6 +26,7 @@ package redis
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -103,6 +104,63 @@ func (c *Client) SAdd(ctx context.Context, key, value string) (int, error) {
 	return redis.Int(conn.Do("SADD", key, value))
 }
 
+func (c *Client) Ping(ctx context.Context) error {
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("PING")
+	return err
+}
+
+func (c *Client) LPush(ctx context.Context, key, value string) (int, error) {
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+	return redis.Int(conn.Do("LPUSH", key, value))
+}
+
+func (c *Client) HLen(ctx context.Context, key string) (int, error) {
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+	return redis.Int(conn.Do("HLEN", key))
+}
+
+// XAdd appends an entry of field-value pairs to a stream and returns its id.
+func (c *Client) XAdd(ctx context.Context, key string, fieldsAndValues ...string) (string, error) {
+	args := make([]interface{}, 0, len(fieldsAndValues)+2)
+	args = append(args, key, "*")
+	for _, v := range fieldsAndValues {
+		args = append(args, v)
+	}
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return redis.String(conn.Do("XADD", args...))
+}
+
+// Get returns "" if the key does not exist.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	reply, err := redis.String(conn.Do("GET", key))
+	if errors.Is(err, redis.ErrNil) {
+		return "", nil
+	}
+	return reply, err
+}
+
 // Eval: Use Lua
 func (c *Client) Eval(ctx context.Context, src string, keyCount int, keysAndArgs []interface{}) (interface{}, error) {
 	args := make([]interface{}, len(keysAndArgs)+2)
@@ -0,0 +1,153 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+// Package signature signs RTimeWheel callbacks with HMAC-SHA256 and verifies them.
+//
+// The signature covers the timestamp, the task key and the body, joined by ".".
+// A request is signed with every active key, so that keys can be rotated by
+// adding the new key to the scheduler, then to the receivers, and removing the
+// old one from both.
+package signature
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderSignature = "X-Timewheel-Signature" // id1=hex1,id2=hex2
+	HeaderTimestamp = "X-Timewheel-Timestamp" // unix seconds
+	HeaderTaskKey   = "X-Timewheel-Task-Key"
+
+	DefaultTolerance = 5 * time.Minute
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrInvalidTimestamp = errors.New("invalid timestamp")
+)
+
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Sign returns the hex encoded signature of a callback.
+func Sign(secret []byte, timestamp int64, taskKey string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write([]byte(taskKey))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Header returns the headers signing a callback with each of the keys.
+func Header(keys []Key, now time.Time, taskKey string, body []byte) map[string]string {
+	timestamp := now.Unix()
+	signatures := make([]string, 0, len(keys))
+	for _, key := range keys {
+		signatures = append(signatures, key.ID+"="+Sign(key.Secret, timestamp, taskKey, body))
+	}
+	return map[string]string{
+		HeaderSignature: strings.Join(signatures, ","),
+		HeaderTimestamp: strconv.FormatInt(timestamp, 10),
+		HeaderTaskKey:   taskKey,
+	}
+}
+
+type Verifier struct {
+	keys      map[string][]byte
+	tolerance time.Duration
+	now       func() time.Time
+}
+
+// NewVerifier returns a Verifier accepting callbacks signed with any of the keys,
+// within tolerance of their timestamp, DefaultTolerance if zero.
+func NewVerifier(tolerance time.Duration, keys ...Key) *Verifier {
+	if tolerance <= 0 {
+		tolerance = DefaultTolerance
+	}
+	v := Verifier{
+		keys:      make(map[string][]byte, len(keys)),
+		tolerance: tolerance,
+		now:       time.Now,
+	}
+	for _, key := range keys {
+		v.keys[key.ID] = key.Secret
+	}
+	return &v
+}
+
+// Verify checks the signature headers of a callback against its body.
+func (v *Verifier) Verify(header http.Header, body []byte) error {
+	timestamp, err := strconv.ParseInt(header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+	if d := v.now().Sub(time.Unix(timestamp, 0)); d > v.tolerance || d < -v.tolerance {
+		return ErrInvalidTimestamp
+	}
+	taskKey := header.Get(HeaderTaskKey)
+	for _, signature := range strings.Split(header.Get(HeaderSignature), ",") {
+		id, sum, ok := strings.Cut(signature, "=")
+		if !ok {
+			continue
+		}
+		secret, ok := v.keys[id]
+		if !ok {
+			continue
+		}
+		if hmac.Equal([]byte(sum), []byte(Sign(secret, timestamp, taskKey, body))) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// Middleware rejects the requests failing Verify with 401 Unauthorized.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := v.Verify(r.Header, body); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,192 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package timewheel
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+)
+
+// OverflowPolicy decides what the worker pool does with a due task when its queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the wheel until the queue has room.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest drops the oldest queued task to make room.
+	OverflowDropOldest
+	// OverflowRunInline runs the task right away on a goroutine of its own,
+	// beyond the workers, so that the wheel never waits for it.
+	OverflowRunInline
+	// OverflowReject rejects the task and calls the reject handler.
+	OverflowReject
+)
+
+var (
+	ErrTaskDropped  = errors.New("task dropped by the worker pool")
+	ErrTaskRejected = errors.New("task rejected by the worker pool")
+)
+
+type poolJob struct {
+	key  string
+	run  func()
+	drop func(err error)
+}
+
+// workerPool runs due tasks on a fixed number of goroutines. Jobs of the same
+// key are run one after another in the order they were submitted.
+type workerPool struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    *list.List
+	running  map[string]bool
+	workers  int
+	capacity int
+	policy   OverflowPolicy
+	onReject func(key string)
+	closed   bool
+}
+
+func newWorkerPool(workers, capacity int, policy OverflowPolicy, onReject func(key string)) *workerPool {
+	if capacity <= 0 {
+		capacity = workers
+	}
+	p := &workerPool{
+		queue:    list.New(),
+		running:  make(map[string]bool),
+		workers:  workers,
+		capacity: capacity,
+		policy:   policy,
+		onReject: onReject,
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *workerPool) start() {
+	for i := 0; i < p.workers; i++ {
+		go p.work()
+	}
+}
+
+// stop drops the queued jobs and lets the workers exit once they are idle.
+func (p *workerPool) stop() {
+	p.mu.Lock()
+	p.closed = true
+	queued := p.queue
+	p.queue = list.New()
+	p.cond.Broadcast()
+	p.mu.Unlock()
+	for e := queued.Front(); e != nil; e = e.Next() {
+		e.Value.(*poolJob).drop(ErrTaskCancelled)
+	}
+}
+
+func (p *workerPool) submit(j *poolJob) {
+	p.mu.Lock()
+	for p.queue.Len() >= p.capacity && !p.closed {
+		switch p.policy {
+		case OverflowDropOldest:
+			oldest := p.queue.Remove(p.queue.Front()).(*poolJob)
+			p.mu.Unlock()
+			oldest.drop(ErrTaskDropped)
+			p.mu.Lock()
+		case OverflowRunInline:
+			if p.running[j.key] {
+				// queue it beyond capacity rather than running two firings of a key at once
+				p.enqueue(j)
+				return
+			}
+			p.running[j.key] = true
+			p.mu.Unlock()
+			// not on the goroutine of the wheel, as the job may call it
+			go p.run(j)
+			return
+		case OverflowReject:
+			p.mu.Unlock()
+			j.drop(ErrTaskRejected)
+			if p.onReject != nil {
+				p.onReject(j.key)
+			}
+			return
+		default:
+			p.cond.Wait()
+		}
+	}
+	if p.closed {
+		p.mu.Unlock()
+		j.drop(ErrTaskCancelled)
+		return
+	}
+	p.enqueue(j)
+}
+
+// enqueue must be called with p.mu held, which it releases.
+func (p *workerPool) enqueue(j *poolJob) {
+	p.queue.PushBack(j)
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+func (p *workerPool) work() {
+	for {
+		p.mu.Lock()
+		e := p.next()
+		for e == nil {
+			if p.closed {
+				p.mu.Unlock()
+				return
+			}
+			p.cond.Wait()
+			e = p.next()
+		}
+		j := p.queue.Remove(e).(*poolJob)
+		p.running[j.key] = true
+		p.cond.Broadcast()
+		p.mu.Unlock()
+		p.run(j)
+	}
+}
+
+// next returns the first queued job whose key is not running, must be called with p.mu held.
+func (p *workerPool) next() *list.Element {
+	for e := p.queue.Front(); e != nil; e = e.Next() {
+		if !p.running[e.Value.(*poolJob).key] {
+			return e
+		}
+	}
+	return nil
+}
+
+func (p *workerPool) run(j *poolJob) {
+	defer func() {
+		p.mu.Lock()
+		delete(p.running, j.key)
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	}()
+	j.run()
+}
@@ -0,0 +1,111 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package timewheel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/demdxx/gocast"
+)
+
+// RetryPolicy controls how an RTask whose callback failed is retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int `json:"max_attempts"`
+	// BackoffBase is the delay before the first retry, doubled on every following one.
+	BackoffBase time.Duration `json:"backoff_base"`
+	// BackoffCap bounds the delay, no bound if zero.
+	BackoffCap time.Duration `json:"backoff_cap"`
+	// Jitter is the fraction of the delay, in [0, 1], which is randomly taken off.
+	Jitter float64 `json:"jitter"`
+}
+
+func (p *RetryPolicy) check() error {
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("invalid max attempts: %d", p.MaxAttempts)
+	}
+	if p.BackoffBase < 0 || p.BackoffCap < 0 {
+		return fmt.Errorf("invalid backoff: base %v, cap %v", p.BackoffBase, p.BackoffCap)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("invalid jitter: %v", p.Jitter)
+	}
+	return nil
+}
+
+// Backoff returns the delay before the given retry, starting from 1.
+func (p *RetryPolicy) Backoff(retry int) time.Duration {
+	d := p.BackoffBase
+	// stop doubling at the cap, or before overflowing without one
+	for i := 1; i < retry && (p.BackoffCap <= 0 || d < p.BackoffCap) && d <= math.MaxInt64/2; i++ {
+		d *= 2
+	}
+	if p.BackoffCap > 0 && d > p.BackoffCap {
+		d = p.BackoffCap
+	}
+	return d - time.Duration(p.Jitter*rand.Float64()*float64(d))
+}
+
+// retry moves a task whose callback failed from the in-flight zset back to a
+// minute zset if its retry policy allows, and reports whether it did, or
+// dropped it for a new task of the same key.
+func (r *RTimeWheel) retry(ctx context.Context, task *RTask) bool {
+	task.Attempt++
+	if task.Retry == nil || task.Attempt >= task.Retry.MaxAttempts {
+		return false
+	}
+	executionTime := r.nextExecutionTime(r.clock.Now().Add(task.Retry.Backoff(task.Attempt)))
+	taskBody, _ := json.Marshal(task)
+	retried, err := r.redisClient.Eval(ctx, LuaRetryTask, 3, []interface{}{
+		r.getInflightKey(),
+		r.getMinuteSlice(executionTime),
+		r.getIndexKey(),
+		task.claimed,
+		executionTime.Unix(),
+		string(taskBody),
+		task.Key,
+		r.getStatusKeyPrefix(),
+		r.clock.Now().Unix(),
+		task.History[len(task.History)-1].Error,
+		r.slotRetentionSeconds(),
+		task.Generation,
+	})
+	if err != nil {
+		log.Printf("cannot retry task %s: %v", task.Key, err)
+		return false
+	}
+	if gocast.ToInt(retried) < 0 {
+		log.Printf("skip retrying task %s, superseded by a new task of the same key", task.Key)
+		return true
+	}
+	r.hooks.OnScheduled(Event{Key: task.Key, ExecutionTime: executionTime})
+	return true
+}
@@ -0,0 +1,282 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package timewheel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/demdxx/gocast"
+)
+
+// RSchedule is a recurring RTask of an RTimeWheel. Its occurrences are RTasks
+// enqueued one at a time: the next one is enqueued when the current one is
+// claimed, so a schedule fires once per occurrence whatever the number of nodes.
+type RSchedule struct {
+	Key  string `json:"key"`
+	Spec string `json:"spec"` // as accepted by ParseCron
+	Task *RTask `json:"task"`
+	// Paused schedules enqueue no occurrence until resumed.
+	Paused bool `json:"paused,omitempty"`
+	// Generation changes whenever the chain of occurrences is restarted, so that
+	// the occurrences of a former chain are dropped.
+	Generation string    `json:"generation"`
+	Next       time.Time `json:"-"` // of the pending occurrence, zero if none
+}
+
+// AddSchedule adds, or replaces, the schedule key running task at every time
+// matching spec, a cron expression or an "@every <duration>" descriptor.
+func (r *RTimeWheel) AddSchedule(ctx context.Context, key, spec string, task *RTask) error {
+	if r.stopped() {
+		return ErrStopped
+	}
+	if _, err := ParseCron(spec); err != nil {
+		return err
+	}
+	if err := r.CheckTask(task); err != nil {
+		return err
+	}
+	task.Key = key
+	return r.saveSchedule(ctx, &RSchedule{
+		Key:        key,
+		Spec:       spec,
+		Task:       task,
+		Generation: r.newGeneration(),
+	}, "")
+}
+
+// GetSchedule returns the schedule key, or ErrTaskNotFound.
+func (r *RTimeWheel) GetSchedule(ctx context.Context, key string) (*RSchedule, error) {
+	schedule, _, err := r.getSchedule(ctx, key)
+	return schedule, err
+}
+
+// ListSchedules returns all the schedules, sorted by key.
+func (r *RTimeWheel) ListSchedules(ctx context.Context) ([]*RSchedule, error) {
+	rawReply, err := r.redisClient.Eval(ctx, LuaListSchedules, 2, []interface{}{
+		r.getSchedulesKey(),
+		r.getScheduleNextKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	replies := gocast.ToInterfaceSlice(rawReply)
+	if len(replies) != 2 {
+		return nil, fmt.Errorf("invalid replies: %v", replies)
+	}
+	next := make(map[string]int64)
+	nextReplies := gocast.ToInterfaceSlice(replies[1])
+	for i := 0; i+1 < len(nextReplies); i += 2 {
+		next[gocast.ToString(nextReplies[i])] = gocast.ToInt64(gocast.ToString(nextReplies[i+1]))
+	}
+	scheduleReplies := gocast.ToInterfaceSlice(replies[0])
+	schedules := make([]*RSchedule, 0, len(scheduleReplies)/2)
+	for i := 0; i+1 < len(scheduleReplies); i += 2 {
+		var schedule RSchedule
+		if err := json.Unmarshal([]byte(gocast.ToString(scheduleReplies[i+1])), &schedule); err != nil {
+			log.Printf("error at unmarshal: %v", err)
+			continue
+		}
+		if sec, ok := next[schedule.Key]; ok {
+			schedule.Next = time.Unix(sec, 0)
+		}
+		schedules = append(schedules, &schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].Key < schedules[j].Key
+	})
+	return schedules, nil
+}
+
+// PauseSchedule stops the schedule key from firing until resumed. The pending
+// occurrence is dropped when due.
+func (r *RTimeWheel) PauseSchedule(ctx context.Context, key string) error {
+	schedule, body, err := r.getSchedule(ctx, key)
+	if err != nil {
+		return err
+	}
+	if schedule.Paused {
+		return nil
+	}
+	schedule.Paused = true
+	return r.saveSchedule(ctx, schedule, body)
+}
+
+// ResumeSchedule makes a paused schedule fire again from now on, skipping the
+// occurrences missed while paused.
+func (r *RTimeWheel) ResumeSchedule(ctx context.Context, key string) error {
+	schedule, body, err := r.getSchedule(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !schedule.Paused {
+		return nil
+	}
+	schedule.Paused = false
+	schedule.Generation = r.newGeneration()
+	return r.saveSchedule(ctx, schedule, body)
+}
+
+// DeleteSchedule deletes the schedule key and its pending occurrence, or returns
+// ErrTaskNotFound.
+func (r *RTimeWheel) DeleteSchedule(ctx context.Context, key string) error {
+	n, err := r.redisClient.Eval(ctx, LuaDeleteSchedule, 3, []interface{}{
+		r.getSchedulesKey(),
+		r.getScheduleNextKey(),
+		r.getIndexKey(),
+		key,
+		r.getStatusKeyPrefix(),
+		r.clock.Now().Unix(),
+		r.statusTTLSeconds(),
+	})
+	if err != nil {
+		return err
+	}
+	if gocast.ToInt(n) == 0 {
+		return ErrTaskNotFound
+	}
+	return nil
+}
+
+func (r *RTimeWheel) getSchedule(ctx context.Context, key string) (*RSchedule, string, error) {
+	rawReply, err := r.redisClient.Eval(ctx, LuaGetSchedule, 2, []interface{}{
+		r.getSchedulesKey(),
+		r.getScheduleNextKey(),
+		key,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	replies := gocast.ToInterfaceSlice(rawReply)
+	if len(replies) == 0 || replies[0] == nil {
+		return nil, "", ErrTaskNotFound
+	}
+	body := gocast.ToString(replies[0])
+	var schedule RSchedule
+	if err := json.Unmarshal([]byte(body), &schedule); err != nil {
+		return nil, "", err
+	}
+	if len(replies) > 1 && replies[1] != nil {
+		schedule.Next = time.Unix(gocast.ToInt64(gocast.ToString(replies[1])), 0)
+	}
+	return &schedule, body, nil
+}
+
+// saveSchedule saves the schedule, unless it is no longer the expected one, and
+// enqueues its next occurrence unless paused.
+func (r *RTimeWheel) saveSchedule(ctx context.Context, schedule *RSchedule, expected string) error {
+	body, _ := json.Marshal(schedule)
+	var next time.Time
+	var occurrence []byte
+	if !schedule.Paused {
+		spec, err := ParseCron(schedule.Spec)
+		if err != nil {
+			return err
+		}
+		now := r.clock.Now()
+		next = spec.Next(now)
+		if !next.IsZero() && !next.After(now) {
+			return fmt.Errorf("schedule %q does not advance past %v", schedule.Spec, now)
+		}
+		if !next.IsZero() {
+			next = r.nextExecutionTime(next)
+			occurrence, _ = json.Marshal(schedule.occurrence())
+		}
+	}
+	score := ""
+	if !next.IsZero() {
+		score = strconv.FormatInt(next.Unix(), 10)
+	}
+	saved, err := r.redisClient.Eval(ctx, LuaSaveSchedule, 4, []interface{}{
+		r.getSchedulesKey(),
+		r.getScheduleNextKey(),
+		r.getMinuteSlice(next),
+		r.getIndexKey(),
+		schedule.Key,
+		expected,
+		string(body),
+		score,
+		string(occurrence),
+		r.getStatusKeyPrefix(),
+		r.clock.Now().Unix(),
+		r.slotRetentionSeconds(),
+	})
+	if err != nil {
+		return err
+	}
+	if gocast.ToInt(saved) == 0 {
+		return fmt.Errorf("schedule %s changed while saving it", schedule.Key)
+	}
+	if !next.IsZero() {
+		r.hooks.OnScheduled(Event{Key: schedule.Key, ExecutionTime: next})
+	}
+	return nil
+}
+
+func (s *RSchedule) occurrence() *RTask {
+	task := *s.Task
+	task.Key = s.Key
+	task.Schedule = s.Spec
+	task.Generation = s.Generation
+	return &task
+}
+
+func (r *RTimeWheel) newGeneration() string {
+	return strconv.FormatInt(r.clock.Now().UnixNano(), 10)
+}
+
+// successor returns the occurrence following the claimed one due at score, or
+// nil if task is not a first attempt of an occurrence or its schedule ended.
+// Occurrences missed by now are skipped.
+func (r *RTimeWheel) successor(task *RTask, score int64, now time.Time) (*RTask, time.Time) {
+	if task.Schedule == "" || task.Attempt > 0 {
+		return nil, time.Time{}
+	}
+	spec, err := ParseCron(task.Schedule)
+	if err != nil {
+		log.Printf("invalid schedule of task %s: %v", task.Key, err)
+		return nil, time.Time{}
+	}
+	next := spec.Next(time.Unix(score, 0))
+	if !next.IsZero() && !next.After(now) {
+		next = spec.Next(now)
+	}
+	if next.IsZero() {
+		return nil, time.Time{}
+	}
+	if !next.After(now) {
+		// a successor due at once would be claimed by every poll
+		log.Printf("schedule %q of task %s does not advance past %v", task.Schedule, task.Key, now)
+		return nil, time.Time{}
+	}
+	successor := *task
+	successor.History = nil
+	return &successor, r.nextExecutionTime(next)
+}
@@ -0,0 +1,137 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package timewheel
+
+import (
+	"context"
+	"sort"
+)
+
+// DrainPolicy decides what TimeWheel.Shutdown does with the pending tasks.
+type DrainPolicy int
+
+const (
+	// DrainCancel cancels the pending tasks.
+	DrainCancel DrainPolicy = iota
+	// DrainRun runs the pending tasks right away, recurring ones a last time.
+	DrainRun
+	// DrainReturn cancels the pending tasks and returns them.
+	DrainReturn
+)
+
+// Stop stops the wheel, cancels the pending tasks and the context of the running jobs
+// without waiting for them.
+func (t *TimeWheel) Stop() {
+	t.cancel()
+	if t.pool != nil {
+		t.pool.stop()
+	}
+	for _, task := range t.stop() {
+		task.handle.cancel()
+	}
+}
+
+// Shutdown stops the wheel gracefully. New tasks are rejected with ErrStopped, the
+// pending ones are handled according to policy, then it waits for the running jobs
+// until ctx is done, when their context gets cancelled and ctx.Err() is returned.
+// With DrainReturn the pending tasks are returned in due-time order.
+func (t *TimeWheel) Shutdown(ctx context.Context, policy DrainPolicy) ([]TaskInfo, error) {
+	stopped := make(chan []*task, 1)
+	go func() {
+		stopped <- t.stop()
+	}()
+	var tasks []*task
+	select {
+	case tasks = <-stopped:
+	case <-ctx.Done():
+		// the loop is stuck handing a task over to a full worker pool
+		t.cancel()
+		if t.pool != nil {
+			t.pool.stop()
+		}
+		tasks = <-stopped
+	}
+
+	var infos []TaskInfo
+	now := t.clock.Now()
+	for _, task := range tasks {
+		switch policy {
+		case DrainRun:
+			fired := Event{Key: task.key, ExecutionTime: task.executionTime, Lateness: now.Sub(task.executionTime)}
+			t.hooks.OnFired(fired)
+			t.dispatch(task, fired)
+		case DrainReturn:
+			infos = append(infos, t.info(task))
+			task.handle.cancel()
+		default:
+			task.handle.cancel()
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		t.inflight.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	t.cancel()
+	if t.pool != nil {
+		t.pool.stop()
+	}
+	for _, task := range tasks {
+		// recurring tasks which ran a last time
+		task.handle.cancelWith(ErrStopped)
+	}
+	return infos, err
+}
+
+// stop stops the loop and takes the pending tasks out of the wheel,
+// only the first call gets them.
+func (t *TimeWheel) stop() []*task {
+	var tasks []*task
+	t.Do(func() {
+		if t.ticker != nil {
+			t.ticker.Stop()
+		}
+		close(t.stopCh)
+		if t.loopDone != nil {
+			<-t.loopDone
+		}
+		tasks = make([]*task, 0, len(t.keyToElementMap))
+		for key, element := range t.keyToElementMap {
+			tasks = append(tasks, element.Value.(*task))
+			delete(t.keyToElementMap, key)
+		}
+		sort.Slice(tasks, func(i, j int) bool {
+			return tasks[i].before(tasks[j])
+		})
+	})
+	return tasks
+}
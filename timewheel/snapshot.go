@@ -0,0 +1,133 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package timewheel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// NamedJob is a job registered under a name with RegisterJob. Unlike a closure,
+// a task made of a job name and encoded args survives Snapshot and Restore.
+type NamedJob func(ctx context.Context, args []byte) error
+
+const snapshotVersion = 1
+
+type snapshot struct {
+	Version int            `json:"version"`
+	Tasks   []snapshotTask `json:"tasks"`
+}
+
+type snapshotTask struct {
+	Key           string    `json:"key"`
+	Job           string    `json:"job"`
+	Args          []byte    `json:"args,omitempty"`
+	ExecutionTime time.Time `json:"execution_time"`
+}
+
+// RegisterJob registers job under name for AddNamedTask and Restore.
+func (t *TimeWheel) RegisterJob(name string, job NamedJob) {
+	t.jobsMu.Lock()
+	defer t.jobsMu.Unlock()
+	t.jobs[name] = job
+}
+
+func (t *TimeWheel) namedJob(name string) (NamedJob, bool) {
+	t.jobsMu.RLock()
+	defer t.jobsMu.RUnlock()
+	job, ok := t.jobs[name]
+	return job, ok
+}
+
+// AddNamedTask adds a task running the job registered under name with args.
+func (t *TimeWheel) AddNamedTask(key, name string, args []byte, executionTime time.Time) (*Handle, error) {
+	job, ok := t.namedJob(name)
+	if !ok {
+		return nil, fmt.Errorf("unregistered job: %s", name)
+	}
+	return t.submit(&task{
+		job: func(ctx context.Context) error {
+			return job(ctx, args)
+		},
+		name:          name,
+		args:          args,
+		handle:        newHandle(t, key, false),
+		key:           key,
+		executionTime: executionTime,
+	}), nil
+}
+
+// Snapshot writes the pending named tasks of the wheel to w as JSON.
+// Tasks added with a closure cannot be persisted and are left out.
+func (t *TimeWheel) Snapshot(w io.Writer) error {
+	s := snapshot{Version: snapshotVersion}
+	if err := t.inLoop(func() {
+		for _, element := range t.keyToElementMap {
+			task := element.Value.(*task)
+			if task.name == "" {
+				continue
+			}
+			s.Tasks = append(s.Tasks, snapshotTask{
+				Key:           task.key,
+				Job:           task.name,
+				Args:          task.args,
+				ExecutionTime: task.executionTime,
+			})
+		}
+	}); err != nil {
+		return err
+	}
+	sort.Slice(s.Tasks, func(i, j int) bool {
+		return s.Tasks[i].ExecutionTime.Before(s.Tasks[j].ExecutionTime)
+	})
+	return json.NewEncoder(w).Encode(&s)
+}
+
+// Restore adds the tasks of a snapshot written by Snapshot. Their jobs must be
+// registered beforehand. Tasks which became overdue run on the next tick.
+func (t *TimeWheel) Restore(r io.Reader) error {
+	var s snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return err
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version: %d", s.Version)
+	}
+	for _, task := range s.Tasks {
+		if _, ok := t.namedJob(task.Job); !ok {
+			return fmt.Errorf("unregistered job: %s", task.Job)
+		}
+	}
+	for _, task := range s.Tasks {
+		if _, err := t.AddNamedTask(task.Key, task.Job, task.Args, task.ExecutionTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -26,7 +26,12 @@ package timewheel
 
 import (
 	"container/list"
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"math"
+	"runtime/debug"
 	"sync"
 	"time"
 )
@@ -38,55 +43,117 @@ const (
 	DefaultTimeInterval = time.Second
 )
 
+var (
+	ErrStopped      = errors.New("timewheel stopped")
+	ErrTaskNotFound = errors.New("task not found")
+	ErrInvalidTask  = errors.New("invalid task")
+)
+
 type task struct {
-	job      func()
-	position int
-	cycle    int
-	key      string
+	job           Job
+	name          string // name of the registered job, empty for a closure
+	args          []byte
+	handle        *Handle
+	key           string
+	executionTime time.Time
+	delay         time.Duration // delay the task was added with, restored by Touch
+	schedule      Schedule      // nil for one-shot tasks
+	expiration    int64         // absolute tick at which the task is due
+	level         int
+	position      int
+}
+
+// wheel is one level of the hierarchical timing wheel. Every slot of level i
+// covers span = slotsNum^i ticks of the level-0 wheel.
+type wheel struct {
+	span  int64
+	slots []*list.List
+}
+
+func newWheel(span int64, slotsNum int) *wheel {
+	w := &wheel{
+		span:  span,
+		slots: make([]*list.List, 0, slotsNum),
+	}
+	for i := 0; i < slotsNum; i++ {
+		w.slots = append(w.slots, list.New())
+	}
+	return w
 }
 
 type TimeWheel struct {
 	sync.Once
+	Options
 	interval        time.Duration
-	ticker          *time.Ticker
+	ticker          Ticker
 	addTaskCh       chan *task
 	removeTaskCh    chan string
-	slots           []*list.List
-	currentPosition int
+	cancelTaskCh    chan *Handle
+	loopCh          chan func()
+	slotsNum        int
+	levels          []*wheel // levels[0] is the finest one, overflow wheels are created on demand
+	start           time.Time
+	currentTick     int64 // tick n is due once n+1 intervals have elapsed since start
+	lateness        *Histogram
 	stopCh          chan struct{}
+	loopDone        chan struct{} // closed when the loop returns, nil before Run
+	inflight        sync.WaitGroup
 	keyToElementMap map[string]*list.Element
+	pool            *workerPool     // nil to run every task on its own goroutine
+	ctx             context.Context // passed to jobs, cancelled on Stop
+	cancel          context.CancelFunc
+	jobsMu          sync.RWMutex
+	jobs            map[string]NamedJob
 }
 
-func NewTimeWheel(slotsNum int, interval time.Duration) *TimeWheel {
-	if slotsNum <= 0 {
+func NewTimeWheel(slotsNum int, interval time.Duration, opts ...Option) *TimeWheel {
+	if slotsNum <= 1 {
 		slotsNum = DefaultSlotNumber
 	}
 	if interval <= 0 {
 		interval = DefaultTimeInterval
 	}
-	tw := TimeWheel{
+	ctx, cancel := context.WithCancel(context.Background())
+	t := TimeWheel{
 		interval:        interval,
 		addTaskCh:       make(chan *task),
 		removeTaskCh:    make(chan string),
-		slots:           make([]*list.List, 0, slotsNum),
+		cancelTaskCh:    make(chan *Handle),
+		loopCh:          make(chan func()),
+		slotsNum:        slotsNum,
+		levels:          []*wheel{newWheel(1, slotsNum)},
+		lateness:        NewHistogram(),
 		stopCh:          make(chan struct{}),
 		keyToElementMap: make(map[string]*list.Element),
+		ctx:             ctx,
+		cancel:          cancel,
+		jobs:            make(map[string]NamedJob),
 	}
-	for i := 0; i < slotsNum; i++ {
-		tw.slots = append(tw.slots, list.New())
+	for _, apply := range opts {
+		apply(&t.Options)
+	}
+	legitimizeOptions(&t.Options)
+	if t.poolWorkers > 0 {
+		t.pool = newWorkerPool(t.poolWorkers, t.poolQueueSize, t.poolPolicy, t.onReject)
 	}
-	return &tw
+	return &t
 }
 
 func (t *TimeWheel) Run() {
-	t.ticker = time.NewTicker(t.interval)
+	t.start = t.clock.Now()
+	t.ticker = t.clock.NewTicker(t.interval)
+	t.loopDone = make(chan struct{})
+	if t.pool != nil {
+		t.pool.start()
+	}
 	go t.run()
 }
 
 func (t *TimeWheel) run() {
+	defer close(t.loopDone)
 	defer func() {
 		if err := recover(); err != nil {
-			log.Println(err)
+			log.Printf("panic in the loop of the timewheel: %v\n%s", err, debug.Stack())
 		}
 	}()
 
@@ -94,52 +161,239 @@ func (t *TimeWheel) run() {
 		select {
 		case <-t.stopCh:
 			return
-		case <-t.ticker.C:
-			t.tick()
+		case now := <-t.ticker.C():
+			t.advance(now)
 		case task := <-t.addTaskCh:
 			t.addTask(task)
 		case key := <-t.removeTaskCh:
-			t.RemoveTask(key)
+			t.removeTask(key)
+		case h := <-t.cancelTaskCh:
+			if element, ok := t.keyToElementMap[h.key]; ok && element.Value.(*task).handle == h {
+				t.removeTask(h.key)
+			}
+		case fn := <-t.loopCh:
+			fn()
 		}
 	}
 }
 
-func (t *TimeWheel) AddTask(key string, job func(), executionTime time.Time) {
-	pos, cycle := t.getPositionAndCycle(executionTime)
-	t.addTaskCh <- &task{
-		job:      job,
-		position: pos,
-		cycle:    cycle,
-		key:      key,
+// inLoop runs fn on the goroutine of the wheel, so that it can safely read or
+// modify the slots, and waits for it.
+func (t *TimeWheel) inLoop(fn func()) error {
+	done := make(chan struct{})
+	select {
+	case t.loopCh <- func() {
+		defer close(done)
+		fn()
+	}:
+	case <-t.stopCh:
+		return ErrStopped
 	}
+	<-done
+	return nil
+}
+
+func (t *TimeWheel) AddTask(key string, job func(), executionTime time.Time) *Handle {
+	return t.AddJob(key, wrapJob(job), executionTime)
+}
+
+// AddJob is like AddTask, but job is given the context of the wheel and
+// its error is reported through the returned handle.
+func (t *TimeWheel) AddJob(key string, job Job, executionTime time.Time) *Handle {
+	return t.submit(&task{
+		job:           job,
+		handle:        newHandle(t, key, false),
+		key:           key,
+		executionTime: executionTime,
+	})
 }
 
+// AddRecurringTask runs job every given duration, starting one period from now.
+func (t *TimeWheel) AddRecurringTask(key string, job func(), every time.Duration) (*Handle, error) {
+	if every <= 0 {
+		return nil, fmt.Errorf("invalid interval: %v", every)
+	}
+	return t.AddScheduledJob(key, wrapJob(job), Every(every)), nil
+}
+
+// AddCronTask runs job on the given cron expression, see ParseCron for the syntax.
+func (t *TimeWheel) AddCronTask(key string, job func(), spec string) (*Handle, error) {
+	schedule, err := ParseCron(spec)
+	if err != nil {
+		return nil, err
+	}
+	return t.AddScheduledJob(key, wrapJob(job), schedule), nil
+}
+
+// AddScheduledJob runs job at every activation time of schedule.
+func (t *TimeWheel) AddScheduledJob(key string, job Job, schedule Schedule) *Handle {
+	h := newHandle(t, key, true)
+	executionTime := schedule.Next(t.clock.Now())
+	if executionTime.IsZero() {
+		h.cancel()
+		return h
+	}
+	return t.submit(&task{
+		job:           job,
+		handle:        h,
+		key:           key,
+		executionTime: executionTime,
+		schedule:      schedule,
+	})
+}
+
+// submit hands a new task to the loop, the task is rejected with ErrStopped
+// once the wheel is stopped.
+func (t *TimeWheel) submit(task *task) *Handle {
+	select {
+	case t.addTaskCh <- task:
+	case <-t.stopCh:
+		task.handle.cancelWith(ErrStopped)
+	}
+	return task.handle
+}
+
+func wrapJob(job func()) Job {
+	return func(context.Context) error {
+		job()
+		return nil
+	}
+}
+
+// RemoveTask removes the task of the given key. For a recurring task all
+// its future occurrences are cancelled.
 func (t *TimeWheel) RemoveTask(key string) {
-	t.removeTaskCh <- key
+	select {
+	case t.removeTaskCh <- key:
+	case <-t.stopCh:
+	}
+}
+
+// Reschedule moves the task of the given key to executionTime, keeping its job.
+func (t *TimeWheel) Reschedule(key string, executionTime time.Time) error {
+	return t.move(key, func(task *task, now time.Time) time.Time {
+		return executionTime
+	})
+}
+
+// Postpone delays the task of the given key by d.
+func (t *TimeWheel) Postpone(key string, d time.Duration) error {
+	return t.move(key, func(task *task, now time.Time) time.Time {
+		return task.executionTime.Add(d)
+	})
 }
 
-func (t *TimeWheel) Stop() {
-	t.Do(func() {
-		t.ticker.Stop()
-		close(t.stopCh)
+// Touch moves the task of the given key to the same delay from now it was added with,
+// e.g. to push back the expiry of an idle session on every access.
+func (t *TimeWheel) Touch(key string) error {
+	return t.move(key, func(task *task, now time.Time) time.Time {
+		return now.Add(task.delay)
 	})
 }
 
-func (t *TimeWheel) tick() {
+func (t *TimeWheel) move(key string, executionTime func(task *task, now time.Time) time.Time) error {
+	var err error
+	if loopErr := t.inLoop(func() {
+		element, ok := t.keyToElementMap[key]
+		if !ok {
+			err = ErrTaskNotFound
+			return
+		}
+		task := element.Value.(*task)
+		_ = t.levels[task.level].slots[task.position].Remove(element)
+		now := t.clock.Now()
+		task.executionTime = executionTime(task, now)
+		task.expiration = t.expirationOf(task.executionTime)
+		t.place(task)
+		t.hooks.OnScheduled(Event{Key: task.key, ExecutionTime: task.executionTime})
+	}); loopErr != nil {
+		return loopErr
+	}
+	return err
+}
+
+func (t *TimeWheel) cancelTask(h *Handle) {
+	select {
+	case t.cancelTaskCh <- h:
+	case <-t.stopCh:
+	}
+}
+
+// Lateness returns the distribution of how late the tasks were dispatched
+// compared to their execution time.
+func (t *TimeWheel) Lateness() HistogramSnapshot {
+	return t.lateness.Snapshot()
+}
+
+// advance executes every tick which is due by now. The ticker drops ticks when
+// the loop is busy, so a single event may have to catch up on several of them.
+func (t *TimeWheel) advance(now time.Time) {
+	due := int64(now.Sub(t.start) / t.interval)
+	for t.currentTick < due {
+		t.tick(now)
+	}
+}
+
+// expirationOf returns the tick at which a task executing at executionTime is due.
+func (t *TimeWheel) expirationOf(executionTime time.Time) int64 {
+	return int64(executionTime.Sub(t.start) / t.interval)
+}
+
+// tick cascades the due slots of the overflow wheels down to the finer ones,
+// then executes everything in the current slot of the level-0 wheel.
+func (t *TimeWheel) tick(now time.Time) {
 	defer func() {
-		t.currentPosition = (t.currentPosition + 1) % len(t.slots)
+		t.currentTick++
 	}()
-	l := t.slots[t.currentPosition]
-	t.execute(l)
+	for level := len(t.levels) - 1; level > 0; level-- {
+		w := t.levels[level]
+		if t.currentTick%w.span != 0 {
+			continue
+		}
+		t.cascade(w, int((t.currentTick/w.span)%int64(t.slotsNum)))
+	}
+	w := t.levels[0]
+	l := w.slots[t.currentTick%int64(t.slotsNum)]
+	t.execute(l, now)
+}
+
+func (t *TimeWheel) cascade(w *wheel, position int) {
+	l := w.slots[position]
+	w.slots[position] = list.New()
+	for e := l.Front(); e != nil; e = e.Next() {
+		t.place(e.Value.(*task))
+	}
 }
 
 func (t *TimeWheel) addTask(task *task) {
-	l := t.slots[task.position]
 	if _, ok := t.keyToElementMap[task.key]; ok {
 		t.removeTask(task.key)
 	}
-	element := l.PushBack(task)
-	t.keyToElementMap[task.key] = element
+	now := t.clock.Now()
+	task.delay = task.executionTime.Sub(now)
+	task.expiration = t.expirationOf(task.executionTime)
+	t.place(task)
+	t.hooks.OnScheduled(Event{Key: task.key, ExecutionTime: task.executionTime})
+}
+
+// place puts the task into the finest wheel whose range still covers it,
+// creating overflow wheels when it is further away than any existing level.
+func (t *TimeWheel) place(task *task) {
+	if task.expiration < t.currentTick {
+		task.expiration = t.currentTick
+	}
+	n := int64(t.slotsNum)
+	level, span := 0, int64(1)
+	for task.expiration/span-t.currentTick/span >= n && span <= math.MaxInt64/n {
+		level++
+		span *= n
+	}
+	for len(t.levels) <= level {
+		t.levels = append(t.levels, newWheel(t.levels[len(t.levels)-1].span*n, t.slotsNum))
+	}
+	task.level = level
+	task.position = int((task.expiration / span) % n)
+	t.keyToElementMap[task.key] = t.levels[level].slots[task.position].PushBack(task)
 }
 
 func (t *TimeWheel) removeTask(key string) {
@@ -149,39 +403,92 @@ func (t *TimeWheel) removeTask(key string) {
 	}
 	delete(t.keyToElementMap, key)
 	task, _ := element.Value.(*task)
-	_ = t.slots[task.position].Remove(element)
+	_ = t.levels[task.level].slots[task.position].Remove(element)
+	task.handle.cancel()
 }
 
-func (t *TimeWheel) execute(l *list.List) {
+// execute runs every task of the current level-0 slot, all of which are due:
+// far-future tasks only reach this slot by being cascaded from overflow wheels.
+func (t *TimeWheel) execute(l *list.List, now time.Time) {
 	for e := l.Front(); e != nil; {
 		taskElement := e.Value.(*task)
-		if taskElement.cycle > 0 {
-			// not yet, skip this
-			taskElement.cycle--
-			e = e.Next()
-			continue
+		fired := Event{
+			Key:           taskElement.key,
+			ExecutionTime: taskElement.executionTime,
+			Lateness:      now.Sub(taskElement.executionTime),
 		}
-
-		go func() {
-			defer func() {
-				if err := recover(); err != nil {
-					log.Println(err)
-				}
-			}()
-			taskElement.job()
-		}()
+		t.lateness.Observe(fired.Lateness)
+		t.hooks.OnFired(fired)
+		t.dispatch(taskElement, fired)
 
 		// delete it after we're done
 		next := e.Next()
 		l.Remove(e)
 		delete(t.keyToElementMap, taskElement.key)
+		t.reschedule(taskElement, now)
 		e = next
 	}
 }
 
-func (t *TimeWheel) getPositionAndCycle(executionTime time.Time) (int, int) {
-	delay := int(time.Until(executionTime))
-	cycle := delay / (len(t.slots) * int(t.interval))
-	pos := (t.currentPosition + delay/int(t.interval)) % len(t.slots)
-	return pos, cycle
+// dispatch runs the task, fired is passed along as the task may be rescheduled
+// meanwhile.
+func (t *TimeWheel) dispatch(task *task, fired Event) {
+	t.inflight.Add(1)
+	if t.pool == nil {
+		go t.runTask(task, fired)
+		return
+	}
+	t.pool.submit(&poolJob{
+		key: task.key,
+		run: func() {
+			t.runTask(task, fired)
+		},
+		drop: func(err error) {
+			defer t.inflight.Done()
+			t.hooks.finished(fired, err)
+			task.handle.fail(err)
+		},
+	})
+}
+
+func (t *TimeWheel) runTask(task *task, fired Event) {
+	defer t.inflight.Done()
+	if !task.handle.start() {
+		return
+	}
+	start := t.clock.Now()
+	var err error
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic at task %s: %v", task.key, r)
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+		fired.Duration = t.clock.Now().Sub(start)
+		t.hooks.finished(fired, err)
+		task.handle.finish(err)
+	}()
+	err = task.job(t.ctx)
+}
+
+// reschedule puts a recurring task back into the wheel for its next occurrence.
+func (t *TimeWheel) reschedule(task *task, now time.Time) {
+	if task.schedule == nil {
+		return
+	}
+	next := task.schedule.Next(task.executionTime)
+	if next.Before(now) {
+		// we fell behind, skip the missed occurrences
+		next = task.schedule.Next(now)
+	}
+	if next.IsZero() {
+		return
+	}
+	task.executionTime = next
+	task.expiration = t.expirationOf(next)
+	if task.expiration <= t.currentTick {
+		// never land in the slot being executed right now
+		task.expiration = t.currentTick + 1
+	}
+	t.place(task)
+	t.hooks.OnScheduled(Event{Key: task.key, ExecutionTime: task.executionTime})
 }
@@ -29,9 +29,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
-	"strings"
+	"runtime/debug"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	http2 "github.com/Nicknamezz00/timewheel/pkg/http"
@@ -39,73 +40,193 @@ import (
 	"github.com/demdxx/gocast"
 )
 
+// keyPrefix starts the keys of every RTimeWheel, whatever its namespace.
+const keyPrefix = "timewheel_redis_"
+
+// redisTimeout bounds the Redis calls of a poll, and of settling a task.
+const redisTimeout = 30 * time.Second
+
 type RTask struct {
-	Key         string            `json:"key"`
-	CallbackURL string            `json:"callback_url"`
-	Method      string            `json:"method"`
-	Req         interface{}       `json:"req"`
-	Header      map[string]string `json:"header"`
+	Key            string            `json:"key"`
+	Type           string            `json:"type,omitempty"`   // of its executor, ExecutorHTTP by default
+	Target         string            `json:"target,omitempty"` // of the executor if not ExecutorHTTP
+	CallbackURL    string            `json:"callback_url"`
+	Method         string            `json:"method"` // GET, POST, PUT, PATCH or DELETE
+	Query          map[string]string `json:"query,omitempty"`
+	Req            interface{}       `json:"req"`                     // JSON body, at most one of Req, Form and Body is set
+	Form           map[string]string `json:"form,omitempty"`          // form-encoded body
+	Body           string            `json:"body,omitempty"`          // raw body
+	BodyEncoding   string            `json:"body_encoding,omitempty"` // of Body, BodyEncodingText by default or BodyEncodingBase64
+	ContentType    string            `json:"content_type,omitempty"`  // overrides the one implied by the body
+	Header         map[string]string `json:"header"`
+	ExpectedStatus []string          `json:"expected_status,omitempty"` // e.g. "204" or "2xx", only 200 if empty
+	Timeout        time.Duration     `json:"timeout,omitempty"`         // of the callback, WithCallbackTimeout's if zero
+	Retry          *RetryPolicy      `json:"retry,omitempty"`
+	Attempt        int               `json:"attempt,omitempty"` // number of failed attempts so far
+	History        []AttemptRecord   `json:"history,omitempty"`
+	Schedule       string            `json:"schedule,omitempty"`   // spec of the RSchedule the task is an occurrence of
+	Generation     string            `json:"generation,omitempty"` // of the RSchedule the task is an occurrence of
+	claimed        string            // member of the in-flight zset while the task is leased
+	due            time.Time         // execution time it was claimed at, zero if reclaimed
 }
 
 type RTimeWheel struct {
 	sync.Once
-	redisClient *redis.Client
-	httpClient  *http2.Client
-	stopCh      chan struct{}
-	ticker      time.Ticker
+	Options
+	redisClient  *redis.Client
+	httpClient   *http2.Client
+	stopCh       chan struct{}
+	loopDone     chan struct{} // closed when the loop returns, nil before Run
+	ticker       Ticker
+	inflight     sync.WaitGroup
+	leaderMu     sync.Mutex
+	fencingToken atomic.Int64 // of the current leadership, 0 when not leading
+	executorsMu  sync.RWMutex
+	executors    map[string]Executor
+	handlers     *funcExecutor
+	limiter      *limiter
+	ctx          context.Context // parent of the callbacks, cancelled when Shutdown gives up
+	cancel       context.CancelFunc
 }
 
-func NewRTimeWheel(redisClient *redis.Client, httpClient *http2.Client) *RTimeWheel {
-	return &RTimeWheel{
+func NewRTimeWheel(redisClient *redis.Client, httpClient *http2.Client, opts ...Option) *RTimeWheel {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := RTimeWheel{
 		redisClient: redisClient,
 		httpClient:  httpClient,
 		stopCh:      make(chan struct{}),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	for _, apply := range opts {
+		apply(&r.Options)
 	}
+	legitimizeOptions(&r.Options)
+	r.limiter = newLimiter(r.maxInFlight, r.maxPerHost)
+	r.registerBuiltinExecutors()
+	return &r
 }
 
 func (r *RTimeWheel) Run() {
-	r.ticker = *time.NewTicker(time.Second)
+	r.ticker = r.clock.NewTicker(r.pollInterval)
+	r.loopDone = make(chan struct{})
 	go r.run()
 }
 
+// Stop stops polling Redis, and resigns the leadership, without waiting for the
+// running callbacks.
 func (r *RTimeWheel) Stop() {
 	r.Do(func() {
-		r.ticker.Stop()
+		if r.ticker != nil {
+			r.ticker.Stop()
+		}
 		close(r.stopCh)
+		if err := r.resign(context.Background()); err != nil {
+			log.Printf("cannot resign leadership: %v", err)
+		}
 	})
 }
 
+// Shutdown stops polling Redis, rejects new tasks with ErrStopped and waits for
+// the running callbacks until ctx is done, when they get cancelled and ctx.Err()
+// is returned. Pending tasks stay in Redis for the next run.
+func (r *RTimeWheel) Shutdown(ctx context.Context) error {
+	r.Stop()
+	if r.loopDone != nil {
+		<-r.loopDone
+	}
+	done := make(chan struct{})
+	go func() {
+		r.inflight.Wait()
+		close(done)
+	}()
+	defer r.cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Ping checks that Redis is reachable.
+func (r *RTimeWheel) Ping(ctx context.Context) error {
+	return r.redisClient.Ping(ctx)
+}
+
+func (r *RTimeWheel) stopped() bool {
+	select {
+	case <-r.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
 func (r *RTimeWheel) AddTask(ctx context.Context, key string, task *RTask, executionTime time.Time) error {
-	if err := r.checkTask(task); err != nil {
-		return err
+	if r.stopped() {
+		return ErrStopped
+	}
+	if err := r.CheckTask(task); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTask, err)
 	}
 	task.Key = key
+	return r.addTask(ctx, task, executionTime)
+}
+
+func (r *RTimeWheel) addTask(ctx context.Context, task *RTask, executionTime time.Time) error {
+	executionTime = r.nextExecutionTime(executionTime)
 	taskBody, _ := json.Marshal(task)
 	_, err := r.redisClient.Eval(ctx, LuaAddTask, 2, []interface{}{
-		r.getMinuteSlice(executionTime),  // minute-level zset timewheel slot
-		r.getDeleteSetKey(executionTime), // set of tasks to be deleted
-		executionTime.Unix(),             // timestamp as score
+		r.getMinuteSlice(executionTime), // minute-level zset timewheel slot
+		r.getIndexKey(),                 // index of the pending tasks by key
+		executionTime.Unix(),            // timestamp as score
 		string(taskBody),
-		key,
+		task.Key,
+		r.getStatusKeyPrefix(),
+		r.clock.Now().Unix(),
+		r.slotRetentionSeconds(),
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	r.hooks.OnScheduled(Event{Key: task.Key, ExecutionTime: executionTime})
+	return nil
 }
 
-func (r *RTimeWheel) RemoveTask(ctx context.Context, key string, executionTime time.Time) error {
-	_, err := r.redisClient.Eval(ctx, LuaDeleteTask, 1, []interface{}{
-		r.getDeleteSetKey(executionTime),
+// RemoveTask cancels the pending task key, or returns ErrTaskNotFound.
+func (r *RTimeWheel) RemoveTask(ctx context.Context, key string) error {
+	if r.stopped() {
+		return ErrStopped
+	}
+	removed, err := r.redisClient.Eval(ctx, LuaRemoveTask, 1, []interface{}{
+		r.getIndexKey(),
 		key,
+		r.getStatusKeyPrefix(),
+		r.clock.Now().Unix(),
+		r.statusTTLSeconds(),
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	if gocast.ToInt(removed) == 0 {
+		return ErrTaskNotFound
+	}
+	return nil
 }
 
 func (r *RTimeWheel) run() {
+	defer close(r.loopDone)
 	for {
 		select {
 		case <-r.stopCh:
 			return
-		case <-r.ticker.C:
-			go r.executeTasks()
+		case <-r.ticker.C():
+			r.inflight.Add(1)
+			go func() {
+				defer r.inflight.Done()
+				r.executeTasks()
+			}()
 		}
 	}
 }
@@ -113,18 +234,53 @@ func (r *RTimeWheel) run() {
 func (r *RTimeWheel) executeTasks() {
 	defer func() {
 		if err := recover(); err != nil {
-			log.Println("panic at executeTasks")
+			log.Printf("panic polling tasks: %v\n%s", err, debug.Stack())
 		}
 	}()
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(r.ctx, redisTimeout)
 	defer cancel()
+	if err := r.renewLeases(ctx); err != nil {
+		log.Printf("cannot renew leases: %v", err)
+	}
 
-	tasks, err := r.getExecutableTasks(ctx)
-	if err != nil {
-		log.Println("cannot get executable tasks")
+	var fencingToken string
+	if r.leaderID != "" {
+		token, err := r.elect(ctx)
+		if err != nil {
+			log.Printf("cannot elect leader: %v", err)
+			return
+		}
+		if token == "" {
+			return
+		}
+		fencingToken = token
+	}
+	limit := r.limiter.free()
+	if limit == 0 {
+		// the tasks stay due, and are claimed once callbacks are done
 		return
 	}
 
+	tasks, err := r.claimTasks(ctx, fencingToken, limit)
+	if err != nil {
+		log.Printf("cannot claim due tasks: %v", err)
+	}
+	if limit > 0 {
+		limit -= len(tasks)
+	}
+	var reclaimed []*RTask
+	if limit != 0 {
+		// the leases left expired are reclaimed by the next polls
+		if reclaimed, err = r.reclaimTasks(ctx, fencingToken, limit); err != nil {
+			log.Printf("cannot reclaim expired leases: %v", err)
+		}
+	}
+	if err := r.sweepIndex(ctx); err != nil {
+		log.Printf("cannot sweep the task index: %v", err)
+	}
+	tasks = append(tasks, reclaimed...)
+	r.limiter.hold(tasks)
+
 	var wg sync.WaitGroup
 	for _, task := range tasks {
 		wg.Add(1)
@@ -132,66 +288,288 @@ func (r *RTimeWheel) executeTasks() {
 		go func() {
 			defer func() {
 				if err := recover(); err != nil {
-					log.Println("panic at for-loop tasks")
+					log.Printf("panic settling task %s: %v\n%s", task.Key, err, debug.Stack())
 				}
+				r.limiter.done(task)
 				wg.Done()
 			}()
-			if err := r.execute(ctx, task); err != nil {
-				log.Println("error at execute task")
-			}
+			r.runTask(task)
 		}()
 	}
 
 	wg.Wait()
 }
 
-func (r *RTimeWheel) execute(ctx context.Context, task *RTask) error {
-	return r.httpClient.JSONDo(ctx, task.Method, task.CallbackURL, task.Header, task.Req, nil)
+// runTask executes a claimed task once the limiter lets it, within its
+// timeout, then acks or fails it. A task cancelled while waiting stays in the
+// in-flight zset, and is reclaimed once its lease expired.
+func (r *RTimeWheel) runTask(task *RTask) {
+	release, err := r.limiter.acquire(r.ctx, task.host())
+	if err != nil {
+		log.Printf("cannot run task %s: %v", task.Key, err)
+		return
+	}
+	defer release()
+
+	fired := Event{Key: task.Key, ExecutionTime: task.due}
+	start := r.clock.Now()
+	if !task.due.IsZero() {
+		fired.Lateness = start.Sub(task.due)
+	}
+	r.hooks.OnFired(fired)
+	timeout := task.Timeout
+	if timeout <= 0 {
+		timeout = r.callbackTimeout
+	}
+	ctx, cancel := context.WithTimeout(r.ctx, timeout)
+	err = r.executeSafely(ctx, task)
+	cancel()
+	fired.Duration = r.clock.Now().Sub(start)
+	r.hooks.finished(fired, err)
+
+	ctx, cancel = context.WithTimeout(r.ctx, redisTimeout)
+	defer cancel()
+	if err != nil {
+		log.Printf("error at execute task %s: %v", task.Key, err)
+		r.fail(ctx, task, err)
+		return
+	}
+	r.ack(ctx, task)
+}
+
+// executeSafely executes the task, turning a panic into a *PanicError.
+func (r *RTimeWheel) executeSafely(ctx context.Context, task *RTask) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	return r.execute(ctx, task)
 }
 
-func (r *RTimeWheel) checkTask(task *RTask) error {
-	if task.Method != http.MethodGet && task.Method != http.MethodPost {
-		return fmt.Errorf("invalid method: %s", task.Method)
+// CheckTask validates a task as AddTask does, through the executor of its type.
+func (r *RTimeWheel) CheckTask(task *RTask) error {
+	executor, err := r.executor(task.Type)
+	if err != nil {
+		return err
+	}
+	if err := executor.Check(task); err != nil {
+		return err
+	}
+	if task.Timeout < 0 {
+		return fmt.Errorf("negative timeout")
 	}
-	if !strings.HasPrefix(task.CallbackURL, "http://") && !strings.HasPrefix(task.CallbackURL, "https://") {
-		return fmt.Errorf("invalid url: %s", task.CallbackURL)
+	if task.Timeout > r.lease {
+		return fmt.Errorf("timeout %v exceeds the lease %v", task.Timeout, r.lease)
+	}
+	if task.Retry != nil {
+		return task.Retry.check()
 	}
 	return nil
 }
 
-func (r *RTimeWheel) getExecutableTasks(ctx context.Context) ([]*RTask, error) {
-	now := time.Now()
-	minuteSlice := r.getMinuteSlice(now)
-	deleteSetKey := r.getDeleteSetKey(now)
+// claimTasks leases the tasks due up to the current second until now plus the
+// lease, going through every minute since the high-water mark, i.e. the last
+// second claimed, so seconds missed while no node was polling are not lost.
+// At most limit tasks are claimed unless it is negative.
+func (r *RTimeWheel) claimTasks(ctx context.Context, fencingToken string, limit int) ([]*RTask, error) {
+	now := r.clock.Now()
 	nowSecond := GetTimeSecond(now)
-	score1 := nowSecond.Unix()
-	score2 := nowSecond.Add(time.Second).Unix()
-	rawReply, err := r.redisClient.Eval(ctx, LuaZRangeTasks, 2, []interface{}{
-		minuteSlice, deleteSetKey, score1, score2,
+	from, err := r.getHighWaterMark(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if from.IsZero() {
+		// no node polled yet, while tasks may have been added
+		from = nowSecond.Add(-r.maxLookback)
+	}
+	if from.After(nowSecond) {
+		from = nowSecond
+	}
+	if nowSecond.Sub(from) > r.maxLookback {
+		log.Printf("skip tasks due from %v to %v, beyond the max lookback", from, nowSecond.Add(-r.maxLookback))
+		from = nowSecond.Add(-r.maxLookback)
+	}
+
+	var tasks []*RTask
+	for minute := from.Truncate(time.Minute); !minute.After(nowSecond); minute = minute.Add(time.Minute) {
+		last := minute.Add(time.Minute - time.Second)
+		if last.After(nowSecond) {
+			last = nowSecond
+		}
+		claimed, full, err := r.claimMinute(ctx, minute, last, now, fencingToken, limit)
+		if err != nil {
+			return tasks, err
+		}
+		tasks = append(tasks, claimed...)
+		if full {
+			break
+		}
+		if limit > 0 {
+			limit -= len(claimed)
+		}
+	}
+	return tasks, nil
+}
+
+// claimMinute claims the tasks of the minute due up to last, enqueuing the
+// successors of the occurrences of schedules at the same time. With limit
+// tasks peeked, the minute is full: some may be left, so the high-water mark
+// stays before the second of the last one.
+func (r *RTimeWheel) claimMinute(ctx context.Context, minute, last, now time.Time, fencingToken string, limit int) ([]*RTask, bool, error) {
+	zsetKey := r.getMinuteSlice(minute)
+	rawReply, err := r.redisClient.Eval(ctx, LuaPeekTasks, 1, []interface{}{
+		zsetKey,
+		last.Unix(),
+		limit,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	peeked := gocast.ToInterfaceSlice(rawReply)
+	full := limit >= 0 && len(peeked)/2 >= limit
+	highWaterMark := last.Unix()
+	if full && len(peeked) > 0 {
+		highWaterMark = gocast.ToInt64(gocast.ToString(peeked[len(peeked)-1])) - 1
+	}
+	dues := make(map[string]time.Time, len(peeked)/2)
+	successors := make(map[string]time.Time)
+	keys := []interface{}{
+		zsetKey,
+		r.getInflightKey(),
+		r.getHighWaterMarkKey(),
+		r.getFencingTokenKey(),
+		r.getSchedulesKey(),
+		r.getScheduleNextKey(),
+		r.getIndexKey(),
+	}
+	args := []interface{}{
+		highWaterMark,
+		now.Add(r.lease).Unix(),
+		fencingToken,
+		r.getStatusKeyPrefix(),
+		now.Unix(),
+		r.statusTTLSeconds(),
+		r.slotRetentionSeconds(),
+	}
+	for i := 0; i+1 < len(peeked); i += 2 {
+		member := gocast.ToString(peeked[i])
+		score := gocast.ToInt64(gocast.ToString(peeked[i+1]))
+		dues[member] = time.Unix(score, 0)
+		successorKey, successorScore, successorBody := zsetKey, "", ""
+		var task RTask
+		if err := json.Unmarshal([]byte(member), &task); err == nil {
+			if successor, next := r.successor(&task, score, now); successor != nil {
+				body, _ := json.Marshal(successor)
+				successorKey, successorScore, successorBody = r.getMinuteSlice(next), strconv.FormatInt(next.Unix(), 10), string(body)
+				successors[member] = next
+			}
+		}
+		keys = append(keys, successorKey)
+		args = append(args, member, successorScore, successorBody)
+	}
+	rawReply, err = r.redisClient.Eval(ctx, LuaClaimTasks, len(keys), append(keys, args...))
+	if err != nil {
+		return nil, false, err
+	}
+	tasks := parseTasks(rawReply)
+	for _, task := range tasks {
+		task.due = dues[task.claimed]
+		if next, ok := successors[task.claimed]; ok {
+			r.hooks.OnScheduled(Event{Key: task.Key, ExecutionTime: next})
+		}
+	}
+	return tasks, full, nil
+}
+
+// getHighWaterMark returns the second following the last claimed one, or zero
+// if none was ever claimed.
+func (r *RTimeWheel) getHighWaterMark(ctx context.Context) (time.Time, error) {
+	reply, err := r.redisClient.Get(ctx, r.getHighWaterMarkKey())
+	if err != nil || reply == "" {
+		return time.Time{}, err
+	}
+	sec, err := strconv.ParseInt(reply, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid high-water mark %q: %w", reply, err)
+	}
+	return time.Unix(sec+1, 0), nil
+}
+
+// nextExecutionTime clamps executionTime to the next second, as the current
+// one may already be claimed.
+func (r *RTimeWheel) nextExecutionTime(executionTime time.Time) time.Time {
+	next := GetTimeSecond(r.clock.Now()).Add(time.Second)
+	if executionTime.Before(next) {
+		return next
+	}
+	return executionTime
+}
+
+// renewLeases extends the leases of the tasks claimed by r and not done yet,
+// waiting for a slot or running, so that only the tasks of dead nodes expire.
+func (r *RTimeWheel) renewLeases(ctx context.Context) error {
+	members := r.limiter.leased()
+	if len(members) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(members)+2)
+	args = append(args, r.getInflightKey(), r.clock.Now().Add(r.lease).Unix())
+	for _, member := range members {
+		args = append(args, member)
+	}
+	_, err := r.redisClient.Eval(ctx, LuaRenewLeases, 1, args)
+	return err
+}
+
+// reclaimTasks renews the expired leases, whose holders are presumed dead, and
+// returns their tasks to be executed again. At most limit tasks are reclaimed
+// unless it is negative.
+func (r *RTimeWheel) reclaimTasks(ctx context.Context, fencingToken string, limit int) ([]*RTask, error) {
+	now := r.clock.Now()
+	rawReply, err := r.redisClient.Eval(ctx, LuaReclaimTasks, 2, []interface{}{
+		r.getInflightKey(),
+		r.getFencingTokenKey(),
+		now.Unix(),
+		now.Add(r.lease).Unix(),
+		fencingToken,
+		limit,
 	})
 	if err != nil {
 		return nil, err
 	}
-	replies := gocast.ToInterfaceSlice(rawReply)
-	if len(replies) == 0 {
-		return nil, fmt.Errorf("invalid replies: %v", replies)
+	return parseTasks(rawReply), nil
+}
+
+// ack releases the lease of a task whose callback succeeded. If it fails the
+// task is executed again once its lease expires.
+func (r *RTimeWheel) ack(ctx context.Context, task *RTask) {
+	if _, err := r.redisClient.Eval(ctx, LuaAckTask, 1, []interface{}{
+		r.getInflightKey(),
+		task.claimed,
+		task.Key,
+		r.getStatusKeyPrefix(),
+		r.clock.Now().Unix(),
+		r.statusTTLSeconds(),
+	}); err != nil {
+		log.Printf("cannot ack task %s: %v", task.Key, err)
 	}
-	delete := gocast.ToStringSlice(replies[0])
-	deletedSet := make(map[string]struct{}, len(delete))
+}
 
-	tasks := make([]*RTask, 0, len(replies)-1)
-	for i := 1; i < len(replies); i++ {
+func parseTasks(rawReply interface{}) []*RTask {
+	replies := gocast.ToInterfaceSlice(rawReply)
+	tasks := make([]*RTask, 0, len(replies))
+	for _, reply := range replies {
+		claimed := gocast.ToString(reply)
 		var t RTask
-		if err := json.Unmarshal([]byte(gocast.ToString(replies[i])), &t); err != nil {
+		if err := json.Unmarshal([]byte(claimed), &t); err != nil {
 			log.Printf("error at unmarshal: %v", err)
 			continue
 		}
-		if _, ok := deletedSet[t.Key]; ok {
-			continue
-		}
+		t.claimed = claimed
 		tasks = append(tasks, &t)
 	}
-	return tasks, nil
+	return tasks
 }
 
 func GetTimeStr(t time.Time) string {
@@ -199,13 +577,68 @@ func GetTimeStr(t time.Time) string {
 }
 
 func GetTimeSecond(t time.Time) time.Time {
-	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local)
+	return t.Truncate(time.Second)
+}
+
+// getKey returns the key of name in the namespace of r. All the keys of a
+// namespace share the namespace as hash tag, hence a Redis Cluster slot, so
+// that any script can touch any of them.
+func (r *RTimeWheel) getKey(name string) string {
+	return fmt.Sprintf("%s{%s}_%s", keyPrefix, r.namespace, name)
 }
 
+// getMinuteSlice names minute zsets in UTC, so that nodes in any time zone,
+// and callers passing times in any location, agree on them.
 func (r *RTimeWheel) getMinuteSlice(executionTime time.Time) string {
-	return fmt.Sprintf("timewheel_redis_task_{%s}", GetTimeStr(executionTime))
+	return r.getKey("task_" + GetTimeStr(executionTime.UTC()))
+}
+
+func (r *RTimeWheel) getIndexKey() string {
+	return r.getKey("index")
+}
+
+func (r *RTimeWheel) getIndexSweepCursorKey() string {
+	return r.getKey("index_sweep_cursor")
+}
+
+func (r *RTimeWheel) getStatusKeyPrefix() string {
+	return r.getKey("status_")
+}
+
+func (r *RTimeWheel) getSchedulesKey() string {
+	return r.getKey("schedules")
+}
+
+func (r *RTimeWheel) getScheduleNextKey() string {
+	return r.getKey("schedule_next")
+}
+
+func (r *RTimeWheel) getHighWaterMarkKey() string {
+	return r.getKey("high_water_mark")
+}
+
+func (r *RTimeWheel) getLeaderKey() string {
+	return r.getKey("leader")
+}
+
+func (r *RTimeWheel) getFencingTokenKey() string {
+	return r.getKey("fencing_token")
+}
+
+func (r *RTimeWheel) getInflightKey() string {
+	return r.getKey("inflight")
+}
+
+func (r *RTimeWheel) getDeadLetterKey() string {
+	return r.getKey("dead_letter")
+}
+
+func (r *RTimeWheel) getDeadLetterIndexKey() string {
+	return r.getKey("dead_letter_index")
 }
 
-func (r *RTimeWheel) getDeleteSetKey(executionTime time.Time) string {
-	return fmt.Sprintf("timewheel_redis_delete_set_{%s}", GetTimeStr(executionTime))
+// slotRetentionSeconds is how long a minute zset outlives its last second, so
+// that it expires once out of reach of the catch up after a downtime.
+func (r *RTimeWheel) slotRetentionSeconds() int64 {
+	return int64((r.maxLookback + time.Minute) / time.Second)
 }
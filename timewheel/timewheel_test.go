@@ -26,12 +26,27 @@
 package timewheel
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	http2 "github.com/Nicknamezz00/timewheel/pkg/http"
 	"github.com/Nicknamezz00/timewheel/pkg/redis"
+	"github.com/Nicknamezz00/timewheel/pkg/signature"
+	"github.com/demdxx/gocast"
 )
 
 func TestTimeWheel(t *testing.T) {
@@ -60,6 +75,527 @@ func TestTimeWheel(t *testing.T) {
 	}
 }
 
+func TestTimeWheelHierarchical(t *testing.T) {
+	tw := NewTimeWheel(2, 10*time.Millisecond)
+	tw.Run()
+	defer tw.Stop()
+
+	delays := []time.Duration{
+		20 * time.Millisecond,
+		70 * time.Millisecond,
+		150 * time.Millisecond,
+		330 * time.Millisecond,
+	}
+	start := time.Now()
+	fired := make(chan time.Duration, len(delays))
+	for i, delay := range delays {
+		delay := delay
+		tw.AddTask(fmt.Sprintf("task%d", i), func() {
+			fired <- delay
+			if elapsed := time.Since(start); elapsed < delay {
+				t.Errorf("task due after %v fired early at %v", delay, elapsed)
+			}
+		}, start.Add(delay))
+	}
+	tw.AddTask("removed", func() {
+		t.Error("removed task fired")
+	}, start.Add(200*time.Millisecond))
+	tw.RemoveTask("removed")
+
+	for i := range delays {
+		select {
+		case delay := <-fired:
+			if delay != delays[i] {
+				t.Fatalf("task due after %v fired out of order, expect %v", delay, delays[i])
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("task due after %v never fired", delays[i])
+		}
+	}
+}
+
+func TestTimeWheelRecurring(t *testing.T) {
+	tw := NewTimeWheel(10, 10*time.Millisecond)
+	tw.Run()
+	defer tw.Stop()
+
+	fired := make(chan struct{}, 100)
+	if _, err := tw.AddRecurringTask("recurring", func() {
+		fired <- struct{}{}
+	}, 30*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-fired:
+		case <-time.After(time.Second):
+			t.Fatalf("occurrence %d never fired", i)
+		}
+	}
+
+	tw.RemoveTask("recurring")
+	<-time.After(50 * time.Millisecond)
+	for len(fired) > 0 {
+		<-fired
+	}
+	<-time.After(100 * time.Millisecond)
+	if len(fired) != 0 {
+		t.Fatalf("%d occurrences fired after removal", len(fired))
+	}
+
+	if _, err := tw.AddCronTask("cron", func() {}, "* * *"); err == nil {
+		t.Fatal("expect error for invalid cron spec")
+	}
+}
+
+func TestTimeWheelHandle(t *testing.T) {
+	tw := NewTimeWheel(10, 10*time.Millisecond)
+	tw.Run()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	now := time.Now()
+
+	done := tw.AddTask("done", func() {}, now.Add(20*time.Millisecond))
+	failed := tw.AddJob("failed", func(context.Context) error {
+		return fmt.Errorf("boom")
+	}, now.Add(20*time.Millisecond))
+	panicked := tw.AddTask("panicked", func() {
+		panic("boom")
+	}, now.Add(20*time.Millisecond))
+	cancelled := tw.AddTask("cancelled", func() {}, now.Add(time.Minute))
+	if status := cancelled.Status(); status != TaskPending {
+		t.Fatalf("status is %v, expect pending", status)
+	}
+	if !cancelled.Cancel() {
+		t.Fatal("cannot cancel a pending task")
+	}
+
+	if err := done.Wait(ctx); err != nil || done.Status() != TaskDone {
+		t.Fatalf("status is %v with %v, expect done", done.Status(), err)
+	}
+	if err := failed.Wait(ctx); err == nil || failed.Status() != TaskFailed {
+		t.Fatalf("status is %v with %v, expect failed", failed.Status(), err)
+	}
+	var panicErr *PanicError
+	if err := panicked.Wait(ctx); !errors.As(err, &panicErr) || panicErr.Value != "boom" {
+		t.Fatalf("error is %v, expect a panic error", err)
+	}
+	if err := cancelled.Wait(ctx); err != ErrTaskCancelled || cancelled.Status() != TaskCancelled {
+		t.Fatalf("status is %v with %v, expect cancelled", cancelled.Status(), err)
+	}
+	if done.Cancel() {
+		t.Fatal("cancelled a finished task")
+	}
+
+	stopped := make(chan error, 1)
+	running := tw.AddJob("running", func(ctx context.Context) error {
+		<-ctx.Done()
+		stopped <- ctx.Err()
+		return ctx.Err()
+	}, now)
+	pending := tw.AddTask("pending", func() {}, now.Add(time.Minute))
+	for running.Status() != TaskRunning {
+		<-time.After(time.Millisecond)
+	}
+	tw.Stop()
+	if err := <-stopped; err != context.Canceled {
+		t.Fatalf("job context error is %v, expect cancelled", err)
+	}
+	if err := pending.Wait(ctx); err != ErrTaskCancelled {
+		t.Fatalf("pending task error is %v after stop, expect cancelled", err)
+	}
+}
+
+func TestTimeWheelFakeClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2023, 6, 14, 0, 0, 0, 0, time.UTC))
+	tw := NewTimeWheel(60, time.Second, WithClock(clock))
+	tw.Run()
+	defer tw.Stop()
+
+	var handles []*Handle
+	for _, delay := range []time.Duration{time.Second, time.Hour, 36 * time.Hour} {
+		handles = append(handles, tw.AddTask(delay.String(), func() {}, clock.Now().Add(delay)))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i, advance := range []time.Duration{time.Hour - time.Second, 2 * time.Second, 36 * time.Hour} {
+		clock.Advance(advance)
+		if err := handles[i].Wait(ctx); err != nil {
+			t.Fatalf("task %d: %v", i, err)
+		}
+		for _, h := range handles[i+1:] {
+			if status := h.Status(); status != TaskPending {
+				t.Fatalf("task %s is %v at %v, expect pending", h.Key(), status, clock.Now())
+			}
+		}
+	}
+}
+
+func TestTimeWheelWorkerPool(t *testing.T) {
+	clock := NewFakeClock(time.Date(2023, 6, 14, 0, 0, 0, 0, time.UTC))
+	rejected := make(chan string, 1)
+	tw := NewTimeWheel(10, time.Second, WithClock(clock), WithWorkerPool(1, 1, OverflowReject), WithRejectHandler(func(key string) {
+		rejected <- key
+	}))
+	tw.Run()
+	defer tw.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	release := make(chan struct{})
+	busy := tw.AddTask("busy", func() {
+		<-release
+	}, clock.Now().Add(time.Second))
+	clock.Advance(2 * time.Second)
+	for busy.Status() != TaskRunning {
+		<-time.After(time.Millisecond)
+	}
+
+	queued := tw.AddTask("queued", func() {}, clock.Now().Add(time.Second))
+	overflow := tw.AddTask("overflow", func() {}, clock.Now().Add(time.Second))
+	clock.Advance(2 * time.Second)
+	if err := overflow.Wait(ctx); err != ErrTaskRejected {
+		t.Fatalf("overflow task error is %v, expect rejected", err)
+	}
+	if key := <-rejected; key != "overflow" {
+		t.Fatalf("rejected %s, expect overflow", key)
+	}
+	if status := queued.Status(); status != TaskPending {
+		t.Fatalf("queued task is %v, expect pending", status)
+	}
+	close(release)
+	if err := queued.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTimeWheelWorkerPoolRunInline(t *testing.T) {
+	clock := NewFakeClock(time.Date(2023, 6, 14, 0, 0, 0, 0, time.UTC))
+	tw := NewTimeWheel(10, time.Second, WithClock(clock), WithWorkerPool(1, 1, OverflowRunInline))
+	tw.Run()
+	defer tw.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	release := make(chan struct{})
+	busy := tw.AddTask("busy", func() {
+		<-release
+	}, clock.Now().Add(time.Second))
+	clock.Advance(2 * time.Second)
+	for busy.Status() != TaskRunning {
+		<-time.After(time.Millisecond)
+	}
+
+	tw.AddTask("queued", func() {}, clock.Now().Add(time.Second))
+	var added *Handle
+	overflow := tw.AddTask("overflow", func() {
+		// calls the wheel, which must not be waiting for this job
+		added = tw.AddTask("added", func() {}, clock.Now().Add(time.Hour))
+	}, clock.Now().Add(time.Second))
+	clock.Advance(2 * time.Second)
+	if err := overflow.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tw.Get(added.Key()); !ok {
+		t.Fatal("task added by the inline job is not pending")
+	}
+	close(release)
+}
+
+func TestTimeWheelWorkerPoolSerializesKey(t *testing.T) {
+	clock := NewFakeClock(time.Date(2023, 6, 14, 0, 0, 0, 0, time.UTC))
+	tw := NewTimeWheel(10, time.Second, WithClock(clock), WithWorkerPool(4, 100, OverflowBlock))
+	tw.Run()
+	defer tw.Stop()
+
+	var active, runs int32
+	var overlapped bool
+	var mu sync.Mutex
+	h := tw.AddScheduledJob("serial", func(context.Context) error {
+		mu.Lock()
+		active++
+		overlapped = overlapped || active > 1
+		mu.Unlock()
+		<-time.After(time.Millisecond)
+		mu.Lock()
+		active--
+		runs++
+		mu.Unlock()
+		return nil
+	}, Every(time.Second))
+	clock.Advance(20 * time.Second)
+	for {
+		mu.Lock()
+		done := runs >= 19
+		mu.Unlock()
+		if done {
+			break
+		}
+		<-time.After(time.Millisecond)
+	}
+	h.Cancel()
+	mu.Lock()
+	defer mu.Unlock()
+	if overlapped {
+		t.Fatal("firings of the same key overlapped")
+	}
+}
+
+func TestTimeWheelSnapshot(t *testing.T) {
+	start := time.Date(2023, 6, 14, 0, 0, 0, 0, time.UTC)
+	fired := make(chan string, 2)
+	greet := func(ctx context.Context, args []byte) error {
+		fired <- string(args)
+		return nil
+	}
+
+	clock := NewFakeClock(start)
+	tw := NewTimeWheel(10, time.Second, WithClock(clock))
+	tw.RegisterJob("greet", greet)
+	tw.Run()
+	if _, err := tw.AddNamedTask("overdue", "greet", []byte("overdue"), start.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.AddNamedTask("later", "greet", []byte("later"), start.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.AddNamedTask("unknown", "nope", nil, start); err == nil {
+		t.Fatal("expect error for an unregistered job")
+	}
+	tw.AddTask("closure", func() {}, start.Add(time.Minute))
+	var buf bytes.Buffer
+	if err := tw.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	tw.Stop()
+
+	restoredClock := NewFakeClock(start.Add(30 * time.Minute))
+	restored := NewTimeWheel(10, time.Second, WithClock(restoredClock))
+	restored.RegisterJob("greet", greet)
+	restored.Run()
+	defer restored.Stop()
+	if err := restored.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	restoredClock.Advance(time.Second)
+	if got := <-fired; got != "overdue" {
+		t.Fatalf("%s fired, expect overdue", got)
+	}
+	restoredClock.Advance(30*time.Minute - 2*time.Second)
+	if len(fired) != 0 {
+		t.Fatal("later task fired early")
+	}
+	restoredClock.Advance(2 * time.Second)
+	if got := <-fired; got != "later" {
+		t.Fatalf("%s fired, expect later", got)
+	}
+}
+
+func TestTimeWheelInspect(t *testing.T) {
+	start := time.Date(2023, 6, 14, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	tw := NewTimeWheel(10, time.Second, WithClock(clock))
+	tw.Run()
+	defer tw.Stop()
+
+	if _, ok := tw.NextDue(); ok {
+		t.Fatal("empty wheel has a next due task")
+	}
+	tw.AddTask("day", func() {}, start.Add(24*time.Hour))
+	tw.AddTask("second", func() {}, start.Add(time.Second))
+	tw.AddTask("minute", func() {}, start.Add(time.Minute))
+
+	if n := tw.Len(); n != 3 {
+		t.Fatalf("len is %d, expect 3", n)
+	}
+	if keys := fmt.Sprint(tw.Keys()); keys != "[second minute day]" {
+		t.Fatalf("keys are %s, expect [second minute day]", keys)
+	}
+	info, ok := tw.Get("minute")
+	if !ok || !info.ExecutionTime.Equal(start.Add(time.Minute)) || info.Cycles != 6 {
+		t.Fatalf("got %+v, expect minute due at %v after 6 cycles", info, start.Add(time.Minute))
+	}
+	if _, ok := tw.Get("nope"); ok {
+		t.Fatal("got a task which was never added")
+	}
+	if next, ok := tw.NextDue(); !ok || next.Key != "second" {
+		t.Fatalf("next due is %+v, expect second", next)
+	}
+
+	clock.Advance(2 * time.Second)
+	if next, ok := tw.NextDue(); !ok || next.Key != "minute" {
+		t.Fatalf("next due is %+v, expect minute", next)
+	}
+	var keys []string
+	tw.Range(func(info TaskInfo) bool {
+		keys = append(keys, info.Key)
+		return false
+	})
+	if fmt.Sprint(keys) != "[minute]" {
+		t.Fatalf("range stopped after %v, expect [minute]", keys)
+	}
+}
+
+func TestTimeWheelReschedule(t *testing.T) {
+	start := time.Date(2023, 6, 14, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	tw := NewTimeWheel(10, time.Second, WithClock(clock))
+	tw.Run()
+	defer tw.Stop()
+
+	expired := tw.AddTask("session", func() {}, start.Add(10*time.Second))
+	clock.Advance(8 * time.Second)
+	if err := tw.Touch("session"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(8 * time.Second)
+	if status := expired.Status(); status != TaskPending {
+		t.Fatalf("touched session is %v, expect pending", status)
+	}
+	if err := tw.Postpone("session", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := tw.Get("session"); !info.ExecutionTime.Equal(start.Add(78 * time.Second)) {
+		t.Fatalf("postponed session is due at %v, expect %v", info.ExecutionTime, start.Add(78*time.Second))
+	}
+	if err := tw.Reschedule("session", start.Add(20*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(5 * time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := expired.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Touch("session"); err != ErrTaskNotFound {
+		t.Fatalf("touching an expired session returns %v, expect not found", err)
+	}
+}
+
+// lossyClock is a FakeClock whose ticker only ticks when told to, like a
+// time.Ticker dropping ticks while its receiver is busy.
+type lossyClock struct {
+	*FakeClock
+	ticks chan time.Time
+}
+
+type lossyTicker chan time.Time
+
+func (t lossyTicker) C() <-chan time.Time {
+	return t
+}
+
+func (t lossyTicker) Stop() {}
+
+func (c *lossyClock) NewTicker(time.Duration) Ticker {
+	return lossyTicker(c.ticks)
+}
+
+func (c *lossyClock) tick(d time.Duration) {
+	c.Advance(d)
+	c.ticks <- c.Now()
+}
+
+func TestTimeWheelCatchUp(t *testing.T) {
+	start := time.Date(2023, 6, 14, 0, 0, 0, 0, time.UTC)
+	clock := &lossyClock{FakeClock: NewFakeClock(start), ticks: make(chan time.Time)}
+	tw := NewTimeWheel(10, time.Second, WithClock(clock))
+	tw.Run()
+	defer tw.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	onTime := tw.AddTask("on-time", func() {}, start.Add(time.Second))
+	late := tw.AddTask("late", func() {}, start.Add(3*time.Second))
+	pending := tw.AddTask("pending", func() {}, start.Add(20*time.Second))
+
+	clock.tick(2 * time.Second)
+	if err := onTime.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the ticks of the next 10 seconds are lost
+	clock.tick(10 * time.Second)
+	if err := late.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if status := pending.Status(); status != TaskPending {
+		t.Fatalf("pending task is %v, expect pending", status)
+	}
+
+	lateness := tw.Lateness()
+	if lateness.Count != 2 || lateness.Sum != 10*time.Second {
+		t.Fatalf("lateness of %d tasks sums to %v, expect 2 tasks 10s late in total", lateness.Count, lateness.Sum)
+	}
+	for i, bound := range lateness.Bounds {
+		if bound == 10*time.Second && lateness.Counts[i] != 1 {
+			t.Fatalf("%d tasks in the 10s lateness bucket, expect 1", lateness.Counts[i])
+		}
+	}
+}
+
+func TestTimeWheelShutdown(t *testing.T) {
+	start := time.Date(2023, 6, 14, 0, 0, 0, 0, time.UTC)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tw := NewTimeWheel(10, time.Second, WithClock(NewFakeClock(start)))
+	tw.Run()
+	tw.AddTask("later", func() {}, start.Add(time.Hour))
+	tw.AddTask("sooner", func() {}, start.Add(time.Minute))
+	pending, err := tw.Shutdown(ctx, DrainReturn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].Key != "sooner" || pending[1].Key != "later" {
+		t.Fatalf("got pending tasks %+v, expect sooner and later", pending)
+	}
+	if err := tw.AddTask("rejected", func() {}, start).Wait(ctx); err != ErrStopped {
+		t.Fatalf("task added after shutdown returns %v, expect stopped", err)
+	}
+
+	tw = NewTimeWheel(10, time.Second, WithClock(NewFakeClock(start)), WithWorkerPool(2, 10, OverflowBlock))
+	tw.Run()
+	ran := tw.AddTask("drained", func() {}, start.Add(time.Hour))
+	if _, err := tw.Shutdown(ctx, DrainRun); err != nil {
+		t.Fatal(err)
+	}
+	if status := ran.Status(); status != TaskDone {
+		t.Fatalf("drained task is %v, expect done", status)
+	}
+
+	tw = NewTimeWheel(10, time.Second, WithClock(NewFakeClock(start)))
+	tw.Run()
+	stuck := tw.AddJob("stuck", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, start)
+	shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer shutdownCancel()
+	if _, err := tw.Shutdown(shutdownCtx, DrainRun); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown returns %v, expect deadline exceeded", err)
+	}
+	if err := stuck.Wait(ctx); err != context.Canceled {
+		t.Fatalf("stuck job returns %v, expect cancelled", err)
+	}
+}
+
+func TestTimeWheelRedisShutdown(t *testing.T) {
+	rtw := NewRTimeWheel(redis.NewClient(network, address, password), http2.NewClient(),
+		WithClock(NewFakeClock(time.Now())))
+	rtw.Run()
+	if err := rtw.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := rtw.AddTask(context.Background(), "test", &RTask{
+		CallbackURL: "http://127.0.0.1/callback",
+		Method:      "POST",
+	}, time.Now()); err != ErrStopped {
+		t.Fatalf("task added after shutdown returns %v, expect stopped", err)
+	}
+}
+
 const (
 	network  = "tcp"
 	address  = "127.0.0.1:6379"
@@ -98,9 +634,919 @@ func TestTimeWheelRedis(t *testing.T) {
 		return
 	}
 
-	if err := rtw.RemoveTask(ctx, "test2", time.Now().Add(4*time.Second)); err != nil {
+	if err := rtw.RemoveTask(ctx, "test2"); err != nil {
 		t.Error(err)
 		return
 	}
 	<-time.After(5 * time.Second)
 }
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := &RetryPolicy{MaxAttempts: 10, BackoffBase: time.Second, BackoffCap: 10 * time.Second}
+	for retry, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		if got := p.Backoff(retry + 1); got != want {
+			t.Errorf("backoff of retry %d is %v, expect %v", retry+1, got, want)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := p.Backoff(3); got < 2*time.Second || got > 4*time.Second {
+			t.Fatalf("backoff with jitter is %v, expect within [2s, 4s]", got)
+		}
+	}
+
+	unbounded := &RetryPolicy{MaxAttempts: 1000, BackoffBase: time.Second}
+	for _, retry := range []int{34, 35, 64, 999} {
+		if got := unbounded.Backoff(retry); got < unbounded.Backoff(retry-1) || got < time.Second {
+			t.Fatalf("unbounded backoff of retry %d is %v, expect it to saturate", retry, got)
+		}
+	}
+}
+
+// newTestRTimeWheel returns an RTimeWheel on the local redis server, skipping the test if there is none.
+func newTestRTimeWheel(t *testing.T, opts ...Option) *RTimeWheel {
+	client := redis.NewClient(network, address, password)
+	conn, err := client.GetConn(context.Background())
+	if err == nil {
+		_, err = conn.Do("PING")
+		conn.Close()
+	}
+	if err != nil {
+		t.Skipf("redis unavailable: %v", err)
+	}
+	return NewRTimeWheel(client, http2.NewClient(), opts...)
+}
+
+func TestTimeWheelRedisDeadLetter(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	rtw := newTestRTimeWheel(t)
+	rtw.Run()
+	defer rtw.Shutdown(context.Background())
+	ctx := context.Background()
+	key := fmt.Sprintf("dead_letter_%d", time.Now().UnixNano())
+	defer rtw.PurgeDeadLetters(ctx, key)
+
+	if err := rtw.AddTask(ctx, key, &RTask{
+		CallbackURL: server.URL,
+		Method:      http.MethodPost,
+		Retry:       &RetryPolicy{MaxAttempts: 2, BackoffBase: time.Second},
+	}, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	<-time.After(5 * time.Second)
+
+	letter, err := rtw.GetDeadLetter(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letter.Attempts) != 2 || letter.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got %d attempts ending with status %d, expect 2 ending with 503", len(letter.Attempts), letter.StatusCode)
+	}
+	if err := rtw.ReplayDeadLetter(ctx, key, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rtw.GetDeadLetter(ctx, key); err != ErrTaskNotFound {
+		t.Fatalf("replayed dead letter is still there: %v", err)
+	}
+	<-time.After(5 * time.Second)
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Fatalf("callback called %d times, expect 4", n)
+	}
+	if n, err := rtw.PurgeDeadLetters(ctx, key); err != nil || n != 1 {
+		t.Fatalf("purged %d dead letters with %v, expect 1", n, err)
+	}
+}
+
+func TestTimeWheelRedisRetrySuperseded(t *testing.T) {
+	var calls int32
+	rtw := newTestRTimeWheel(t)
+	later := time.Now().Add(time.Hour)
+	rtw.RegisterHandler("replace", func(ctx context.Context, task *RTask) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// a new task of the key is added while the first one is in flight
+			if err := rtw.AddTask(ctx, task.Key, &RTask{Type: ExecutorFunc, Target: "replace"}, later); err != nil {
+				return err
+			}
+		}
+		return errors.New("failed")
+	})
+	rtw.Run()
+	defer rtw.Shutdown(context.Background())
+	ctx := context.Background()
+	key := fmt.Sprintf("superseded_%d", time.Now().UnixNano())
+
+	if err := rtw.AddTask(ctx, key, &RTask{
+		Type:   ExecutorFunc,
+		Target: "replace",
+		Retry:  &RetryPolicy{MaxAttempts: 3, BackoffBase: time.Second},
+	}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	<-time.After(4 * time.Second)
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("handler called %d times, expect the superseded task not retried", n)
+	}
+	info, err := rtw.GetTask(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Task == nil || info.Task.Retry != nil || info.ExecutionTime.Before(later.Add(-time.Second)) {
+		t.Fatalf("got %+v, expect the new task pending", info)
+	}
+	if err := rtw.RemoveTask(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTimeWheelRedisLease(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer server.Close()
+
+	rtw := newTestRTimeWheel(t)
+	ctx := context.Background()
+	// a task claimed by a node which died before acking it
+	body, _ := json.Marshal(&RTask{
+		Key:         fmt.Sprintf("lease_%d", time.Now().UnixNano()),
+		CallbackURL: server.URL,
+		Method:      http.MethodPost,
+	})
+	if _, err := rtw.redisClient.Eval(ctx, `return redis.call('zadd', KEYS[1], ARGV[1], ARGV[2])`, 1, []interface{}{
+		rtw.getInflightKey(), time.Now().Add(-time.Second).Unix(), string(body),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rtw.Run()
+	defer rtw.Shutdown(context.Background())
+	<-time.After(3 * time.Second)
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("callback called %d times, expect 1", n)
+	}
+	score, err := rtw.redisClient.Eval(ctx, `return redis.call('zscore', KEYS[1], ARGV[1])`, 1, []interface{}{
+		rtw.getInflightKey(), string(body),
+	})
+	if err != nil || score != nil {
+		t.Fatalf("task still leased with score %v, err %v", score, err)
+	}
+}
+
+func TestTimeWheelRedisCatchUp(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer server.Close()
+
+	rtw := newTestRTimeWheel(t)
+	ctx := context.Background()
+	// tasks due while no node was polling, the last claimed second being 2 minutes ago
+	down := time.Now().Add(-2 * time.Minute)
+	if _, err := rtw.redisClient.Eval(ctx, `return redis.call('set', KEYS[1], ARGV[1])`, 1, []interface{}{
+		rtw.getHighWaterMarkKey(), down.Unix(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i, executionTime := range []time.Time{down.Add(time.Second), down.Add(time.Minute), time.Now().Add(-time.Second)} {
+		body, _ := json.Marshal(&RTask{
+			Key:         fmt.Sprintf("catch_up_%d_%d", i, time.Now().UnixNano()),
+			CallbackURL: server.URL,
+			Method:      http.MethodPost,
+		})
+		if _, err := rtw.redisClient.Eval(ctx, `return redis.call('zadd', KEYS[1], ARGV[1], ARGV[2])`, 1, []interface{}{
+			rtw.getMinuteSlice(executionTime), executionTime.Unix(), string(body),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rtw.Run()
+	defer rtw.Shutdown(context.Background())
+	<-time.After(2 * time.Second)
+
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("callback called %d times, expect 3", n)
+	}
+}
+
+func TestTimeWheelRedisFirstPoll(t *testing.T) {
+	var calls int32
+	namespace := fmt.Sprintf("first_poll_%d", time.Now().UnixNano())
+	// a task added by a producer 5 minutes before any node polled
+	producer := newTestRTimeWheel(t, WithNamespace(namespace), WithClock(NewFakeClock(time.Now().Add(-5*time.Minute))))
+	rtw := newTestRTimeWheel(t, WithNamespace(namespace))
+	for _, w := range []*RTimeWheel{producer, rtw} {
+		w.RegisterHandler("count", func(ctx context.Context, task *RTask) error {
+			atomic.AddInt32(&calls, 1)
+			return nil
+		})
+	}
+	ctx := context.Background()
+	if err := producer.AddTask(ctx, "first_poll", &RTask{Type: ExecutorFunc, Target: "count"}, producer.clock.Now().Add(10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	rtw.Run()
+	defer rtw.Shutdown(context.Background())
+	<-time.After(2 * time.Second)
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("handler called %d times, expect 1", n)
+	}
+}
+
+func TestTimeWheelRedisLeaderElection(t *testing.T) {
+	id := fmt.Sprintf("%d", time.Now().UnixNano())
+	first := newTestRTimeWheel(t, WithLeaderElection(id+"_first", 3*time.Second))
+	second := newTestRTimeWheel(t, WithLeaderElection(id+"_second", 3*time.Second))
+	first.Run()
+	<-time.After(1500 * time.Millisecond)
+	second.Run()
+	defer second.Shutdown(context.Background())
+	<-time.After(1500 * time.Millisecond)
+
+	if !first.IsLeader() || second.IsLeader() {
+		t.Fatalf("first is leader: %v, second is leader: %v, expect only the first", first.IsLeader(), second.IsLeader())
+	}
+	token := strconv.FormatInt(first.fencingToken.Load(), 10)
+	first.Stop()
+	<-time.After(1500 * time.Millisecond)
+
+	if !second.IsLeader() {
+		t.Fatal("second did not take over the leadership")
+	}
+	if _, err := first.claimTasks(context.Background(), token, -1); err == nil {
+		t.Fatal("claimed tasks with a stale fencing token")
+	}
+}
+
+func TestTimeWheelRedisSigning(t *testing.T) {
+	oldKey := signature.Key{ID: "old", Secret: []byte("old secret")}
+	newKey := signature.Key{ID: "new", Secret: []byte("new secret")}
+	var verified, rejected int32
+	verifier := signature.NewVerifier(time.Minute, newKey)
+	server := httptest.NewServer(verifier.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&verified, 1)
+	})))
+	defer server.Close()
+	forged := httptest.NewServer(signature.NewVerifier(time.Minute, signature.Key{ID: "new", Secret: []byte("forged")}).
+		Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&rejected, 1)
+		})))
+	defer forged.Close()
+
+	// rotating from the old key to the new one
+	rtw := newTestRTimeWheel(t, WithSigningKeys(oldKey, newKey))
+	rtw.Run()
+	defer rtw.Shutdown(context.Background())
+	ctx := context.Background()
+	for _, url := range []string{server.URL, forged.URL} {
+		key := fmt.Sprintf("signing_%d", time.Now().UnixNano())
+		defer rtw.PurgeDeadLetters(ctx, key)
+		if err := rtw.AddTask(ctx, key, &RTask{
+			CallbackURL: url,
+			Method:      http.MethodPost,
+			Req:         map[string]string{"hello": "world"},
+		}, time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-time.After(3 * time.Second)
+
+	if v, r := atomic.LoadInt32(&verified), atomic.LoadInt32(&rejected); v != 1 || r != 0 {
+		t.Fatalf("%d callbacks verified and %d forged accepted, expect 1 and 0", v, r)
+	}
+}
+
+func TestRTaskPayload(t *testing.T) {
+	type request struct {
+		method, contentType, query, body string
+	}
+	var got request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got = request{r.Method, r.Header.Get("Content-Type"), r.URL.RawQuery, string(body)}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	rtw := NewRTimeWheel(redis.NewClient(network, address, password), http2.NewClient())
+	tests := []struct {
+		task   RTask
+		expect request
+	}{
+		{
+			RTask{Method: http.MethodPut, Req: map[string]int{"a": 1}, ExpectedStatus: []string{"202"}},
+			request{http.MethodPut, "application/json", "", `{"a":1}`},
+		},
+		{
+			RTask{Method: http.MethodPatch, Form: map[string]string{"a": "1 2"}, ExpectedStatus: []string{"2xx"}},
+			request{http.MethodPatch, "application/x-www-form-urlencoded", "", "a=1+2"},
+		},
+		{
+			RTask{Method: http.MethodPost, Body: "aGVsbG8=", BodyEncoding: BodyEncodingBase64, ExpectedStatus: []string{"2xx"}},
+			request{http.MethodPost, "application/octet-stream", "", "hello"},
+		},
+		{
+			RTask{Method: http.MethodDelete, Query: map[string]string{"id": "1"}, ExpectedStatus: []string{"204", "202"}},
+			request{http.MethodDelete, "", "id=1", ""},
+		},
+	}
+	for _, test := range tests {
+		task := test.task
+		task.CallbackURL = server.URL
+		if err := rtw.CheckTask(&task); err != nil {
+			t.Fatal(err)
+		}
+		if err := rtw.execute(context.Background(), &task); err != nil {
+			t.Fatal(err)
+		}
+		if got != test.expect {
+			t.Fatalf("got %+v, expect %+v", got, test.expect)
+		}
+	}
+
+	task := RTask{Method: http.MethodPost, CallbackURL: server.URL}
+	var statusErr *http2.StatusError
+	if err := rtw.execute(context.Background(), &task); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status returns %v, expect a status error", err)
+	}
+	task = RTask{Method: http.MethodPost, CallbackURL: server.URL, Req: 1, Body: "1"}
+	if err := rtw.CheckTask(&task); err == nil {
+		t.Fatal("task with two bodies is valid")
+	}
+}
+
+type recordExecutor struct {
+	executed []string
+}
+
+func (e *recordExecutor) Check(task *RTask) error {
+	return nil
+}
+
+func (e *recordExecutor) Execute(ctx context.Context, task *RTask) error {
+	e.executed = append(e.executed, task.Key)
+	return nil
+}
+
+func TestRTimeWheelExecutors(t *testing.T) {
+	rtw := newTestRTimeWheel(t)
+	ctx := context.Background()
+	suffix := fmt.Sprintf("%d", time.Now().UnixNano())
+
+	var handled string
+	rtw.RegisterHandler("greet", func(ctx context.Context, task *RTask) error {
+		handled = task.Body
+		return nil
+	})
+	custom := &recordExecutor{}
+	rtw.RegisterExecutor("custom", custom)
+
+	socket := filepath.Join(t.TempDir(), "timewheel.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		body, _ := io.ReadAll(conn)
+		received <- string(body)
+	}()
+
+	list, stream := "executor_list_"+suffix, "executor_stream_"+suffix
+	for _, task := range []*RTask{
+		{Key: "func", Type: ExecutorFunc, Target: "greet", Body: "hello"},
+		{Key: "custom", Type: "custom"},
+		{Key: "unix", Type: ExecutorUnix, Target: socket, Body: "hello"},
+		{Key: "list", Type: ExecutorRedisList, Target: list, Body: "hello"},
+		{Key: "stream", Type: ExecutorRedisStream, Target: stream, Body: "hello"},
+	} {
+		if err := rtw.CheckTask(task); err != nil {
+			t.Fatal(err)
+		}
+		if err := rtw.execute(ctx, task); err != nil {
+			t.Fatalf("execute %s: %v", task.Key, err)
+		}
+	}
+	if handled != "hello" || len(custom.executed) != 1 || <-received != "hello" {
+		t.Fatalf("handled %q, custom executed %v", handled, custom.executed)
+	}
+	pushed, err := rtw.redisClient.Eval(ctx, `return {redis.call('rpop', KEYS[1]), redis.call('xlen', KEYS[2])}`, 2, []interface{}{list, stream})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replies := gocast.ToInterfaceSlice(pushed); gocast.ToString(replies[0]) != "hello" || gocast.ToInt(replies[1]) != 1 {
+		t.Fatalf("pushed %v to the list and stream, expect hello and 1 entry", replies)
+	}
+	if err := rtw.CheckTask(&RTask{Type: ExecutorFunc, Target: "missing"}); err == nil {
+		t.Fatal("task of an unregistered handler is valid")
+	}
+	if err := rtw.CheckTask(&RTask{Type: "missing"}); err == nil {
+		t.Fatal("task of an unregistered type is valid")
+	}
+	if err := rtw.CheckTask(&RTask{Type: ExecutorRedisList, Target: rtw.getLeaderKey(), Body: "hello"}); err == nil {
+		t.Fatal("task pushing to a key of the wheel is valid")
+	}
+}
+
+func TestRTimeWheelSchedule(t *testing.T) {
+	var calls int32
+	rtw := newTestRTimeWheel(t)
+	rtw.RegisterHandler("count", func(ctx context.Context, task *RTask) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+	rtw.Run()
+	defer rtw.Shutdown(context.Background())
+	ctx := context.Background()
+	key := fmt.Sprintf("schedule_%d", time.Now().UnixNano())
+	defer rtw.DeleteSchedule(ctx, key)
+
+	if err := rtw.AddSchedule(ctx, key, "@every 1s", &RTask{Type: ExecutorFunc, Target: "count"}); err != nil {
+		t.Fatal(err)
+	}
+	<-time.After(3500 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n < 2 || n > 4 {
+		t.Fatalf("schedule fired %d times in 3.5s, expect about 3", n)
+	}
+	schedules, err := rtw.ListSchedules(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed *RSchedule
+	for _, schedule := range schedules {
+		if schedule.Key == key {
+			listed = schedule
+		}
+	}
+	if listed == nil || listed.Next.IsZero() || listed.Paused {
+		t.Fatalf("listed schedule %+v, expect it pending", listed)
+	}
+
+	if err := rtw.PauseSchedule(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	<-time.After(100 * time.Millisecond) // for an occurrence claimed meanwhile
+	paused := atomic.LoadInt32(&calls)
+	<-time.After(2500 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != paused {
+		t.Fatalf("paused schedule fired %d times, expect none", n-paused)
+	}
+	if err := rtw.ResumeSchedule(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	<-time.After(2500 * time.Millisecond)
+	resumed := atomic.LoadInt32(&calls)
+	if resumed-paused < 1 || resumed-paused > 3 {
+		t.Fatalf("resumed schedule fired %d times in 2.5s, expect about 2", resumed-paused)
+	}
+
+	if err := rtw.DeleteSchedule(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	<-time.After(2 * time.Second)
+	if n := atomic.LoadInt32(&calls); n != resumed {
+		t.Fatalf("deleted schedule fired %d times, expect none", n-resumed)
+	}
+	if _, err := rtw.GetSchedule(ctx, key); err != ErrTaskNotFound {
+		t.Fatalf("deleted schedule is still there: %v", err)
+	}
+}
+
+func TestRTimeWheelScheduleRetry(t *testing.T) {
+	var retried int32
+	rtw := newTestRTimeWheel(t)
+	rtw.RegisterHandler("fail", func(ctx context.Context, task *RTask) error {
+		if task.Attempt > 0 {
+			atomic.AddInt32(&retried, 1)
+		}
+		return errors.New("failed")
+	})
+	rtw.Run()
+	defer rtw.Shutdown(context.Background())
+	ctx := context.Background()
+	key := fmt.Sprintf("schedule_retry_%d", time.Now().UnixNano())
+	defer rtw.DeleteSchedule(ctx, key)
+
+	if err := rtw.AddSchedule(ctx, key, "@every 5s", &RTask{
+		Type:   ExecutorFunc,
+		Target: "fail",
+		Retry:  &RetryPolicy{MaxAttempts: 2, BackoffBase: time.Second},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	<-time.After(8 * time.Second)
+	if atomic.LoadInt32(&retried) == 0 {
+		t.Fatal("the failed occurrence was not retried")
+	}
+	// the successor was indexed under the key when the occurrence was claimed
+	info, err := rtw.GetTask(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Task == nil || info.Task.Attempt != 0 || !info.ExecutionTime.After(time.Now()) {
+		t.Fatalf("got %+v, expect the next occurrence pending", info)
+	}
+}
+
+func TestRTimeWheelTimeZones(t *testing.T) {
+	var calls int32
+	rtw := newTestRTimeWheel(t, WithNamespace(fmt.Sprintf("zones_%d", time.Now().UnixNano())))
+	rtw.RegisterHandler("count", func(ctx context.Context, task *RTask) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+	rtw.Run()
+	defer rtw.Shutdown(context.Background())
+	ctx := context.Background()
+
+	// times of any location name the same minute zsets as the local ones
+	now := time.Now()
+	executionTime := now.Add(2 * time.Second).In(time.FixedZone("UTC+5:30", 5*3600+1800))
+	if err := rtw.AddTask(ctx, "zones", &RTask{Type: ExecutorFunc, Target: "count"}, executionTime); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := rtw.ListTasks(ctx, now.UTC(), now.Add(time.Minute).In(time.FixedZone("UTC-7", -7*3600)), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Fatalf("listed %d tasks, expect 1", len(infos))
+	}
+	<-time.After(3500 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("handler called %d times, expect 1", n)
+	}
+}
+
+func TestRTimeWheelTaskIndex(t *testing.T) {
+	rtw := newTestRTimeWheel(t)
+	rtw.RegisterHandler("noop", func(ctx context.Context, task *RTask) error {
+		return nil
+	})
+	rtw.Run()
+	defer rtw.Shutdown(context.Background())
+	ctx := context.Background()
+	suffix := fmt.Sprintf("%d", time.Now().UnixNano())
+	done, removed := "index_done_"+suffix, "index_removed_"+suffix
+
+	for _, key := range []string{done, removed} {
+		if err := rtw.AddTask(ctx, key, &RTask{Type: ExecutorFunc, Target: "noop"}, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := rtw.GetTask(ctx, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Status != RTaskScheduled || info.Task == nil || info.ExecutionTime.Before(time.Now().Add(time.Minute)) {
+		t.Fatalf("got %+v, expect the task scheduled in an hour", info)
+	}
+	if err := rtw.Reschedule(ctx, done, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rtw.RemoveTask(ctx, removed); err != nil {
+		t.Fatal(err)
+	}
+	if err := rtw.RemoveTask(ctx, removed); err != ErrTaskNotFound {
+		t.Fatalf("removing a removed task returns %v, expect not found", err)
+	}
+	<-time.After(2500 * time.Millisecond)
+
+	for key, status := range map[string]RTaskStatus{done: RTaskSucceeded, removed: RTaskCancelled} {
+		info, err := rtw.GetTask(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Status != status || info.Task != nil {
+			t.Fatalf("got %+v for %s, expect %s and no pending task", info, key, status)
+		}
+	}
+}
+
+func TestRTimeWheelNamespace(t *testing.T) {
+	suffix := fmt.Sprintf("%d", time.Now().UnixNano())
+	rtw := newTestRTimeWheel(t, WithNamespace("a_"+suffix))
+	other := newTestRTimeWheel(t, WithNamespace("b_"+suffix))
+	// braces would break the hash tag of the keys
+	if key := newTestRTimeWheel(t, WithNamespace("{a}_"+suffix)).getIndexKey(); key != rtw.getIndexKey() {
+		t.Fatalf("got key %s, expect %s", key, rtw.getIndexKey())
+	}
+	rtw.RegisterHandler("noop", func(ctx context.Context, task *RTask) error {
+		return nil
+	})
+	ctx := context.Background()
+
+	executionTime := time.Now().Add(time.Hour)
+	if err := rtw.AddTask(ctx, "namespaced", &RTask{Type: ExecutorFunc, Target: "noop"}, executionTime); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rtw.GetTask(ctx, "namespaced"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.GetTask(ctx, "namespaced"); err != ErrTaskNotFound {
+		t.Fatalf("got %v from another namespace, expect not found", err)
+	}
+	ttl, err := rtw.redisClient.Eval(ctx, "return redis.call('ttl', KEYS[1])", 1, []interface{}{rtw.getMinuteSlice(executionTime)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _ := ttl.(int64); ttl < int64(time.Hour/time.Second) || ttl > rtw.slotRetentionSeconds()+int64(time.Hour/time.Second)+1 {
+		t.Fatalf("minute zset expires in %vs, expect after the task and its lookback", ttl)
+	}
+	if err := rtw.RemoveTask(ctx, "namespaced"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a task left in a minute zset which expired
+	for _, key := range []string{"expired", "swept"} {
+		if err := rtw.AddTask(ctx, key, &RTask{Type: ExecutorFunc, Target: "noop"}, executionTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := rtw.redisClient.Eval(ctx, "return redis.call('del', KEYS[1])", 1, []interface{}{rtw.getMinuteSlice(executionTime)}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := rtw.GetTask(ctx, "expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Status != RTaskCancelled || info.Task != nil {
+		t.Fatalf("got %+v, expect the expired task cancelled", info)
+	}
+	if err := rtw.sweepIndex(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := rtw.Len(ctx); err != nil || n != 0 {
+		t.Fatalf("%d tasks pending, err %v, expect the expired ones swept", n, err)
+	}
+}
+
+func TestRTimeWheelCallbackLimits(t *testing.T) {
+	var running, maxRunning atomic.Int64
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for m := maxRunning.Load(); n > m && !maxRunning.CompareAndSwap(m, n); m = maxRunning.Load() {
+		}
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer slow.Close()
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hanging.Close()
+
+	rtw := newTestRTimeWheel(t, WithMaxInFlight(2), WithMaxPerHost(1))
+	rtw.Run()
+	defer rtw.Shutdown(context.Background())
+	ctx := context.Background()
+	suffix := fmt.Sprintf("%d", time.Now().UnixNano())
+	executionTime := time.Now().Add(time.Second)
+
+	if err := rtw.AddTask(ctx, "limits_timeout_"+suffix, &RTask{
+		CallbackURL: hanging.URL,
+		Method:      http.MethodGet,
+		Timeout:     100 * time.Millisecond,
+	}, executionTime); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := rtw.AddTask(ctx, fmt.Sprintf("limits_slow_%d_%s", i, suffix), &RTask{
+			CallbackURL: slow.URL,
+			Method:      http.MethodGet,
+		}, executionTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rtw.AddTask(ctx, "limits_too_long", &RTask{CallbackURL: slow.URL, Method: http.MethodGet, Timeout: time.Hour}, executionTime); err == nil {
+		t.Fatal("expect a timeout beyond the lease rejected")
+	}
+	<-time.After(3500 * time.Millisecond)
+
+	if got := maxRunning.Load(); got != 1 {
+		t.Fatalf("got %d concurrent callbacks to the same host, expect 1", got)
+	}
+	for i := 0; i < 3; i++ {
+		info, err := rtw.GetTask(ctx, fmt.Sprintf("limits_slow_%d_%s", i, suffix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Status != RTaskSucceeded {
+			t.Fatalf("got %+v, expect the slow task succeeded", info)
+		}
+	}
+	info, err := rtw.GetTask(ctx, "limits_timeout_"+suffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Status != RTaskFailed {
+		t.Fatalf("got %+v, expect the hanging task timed out", info)
+	}
+}
+
+func TestRTimeWheelReclaimLimit(t *testing.T) {
+	release := make(chan struct{})
+	var calls int32
+	rtw := newTestRTimeWheel(t, WithNamespace(fmt.Sprintf("reclaim_%d", time.Now().UnixNano())), WithMaxInFlight(1))
+	rtw.RegisterHandler("block", func(ctx context.Context, task *RTask) error {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return nil
+	})
+	ctx := context.Background()
+	// tasks claimed by a node which died before acking them
+	for i := 0; i < 3; i++ {
+		body, _ := json.Marshal(&RTask{Key: fmt.Sprintf("reclaim_%d", i), Type: ExecutorFunc, Target: "block"})
+		if _, err := rtw.redisClient.Eval(ctx, `return redis.call('zadd', KEYS[1], ARGV[1], ARGV[2])`, 1, []interface{}{
+			rtw.getInflightKey(), time.Now().Add(-time.Second).Unix(), string(body),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rtw.Run()
+	defer rtw.Shutdown(context.Background())
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	defer unblock()
+	<-time.After(1500 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("handler called %d times, expect 1", n)
+	}
+	// the other leases are left expired for the next polls, not renewed for nothing
+	expired, err := rtw.redisClient.Eval(ctx, `return redis.call('zcount', KEYS[1], '-inf', ARGV[1])`, 1, []interface{}{
+		rtw.getInflightKey(), time.Now().Unix(),
+	})
+	if err != nil || gocast.ToInt(expired) != 2 {
+		t.Fatalf("%v leases expired, err %v, expect 2", expired, err)
+	}
+	unblock()
+	<-time.After(2500 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("handler called %d times, expect 3", n)
+	}
+}
+
+// recordingHooks records events as "<event> <key>".
+type recordingHooks struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (h *recordingHooks) record(event string, e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, event+" "+e.Key)
+}
+
+func (h *recordingHooks) has(event string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, e := range h.events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *recordingHooks) OnScheduled(e Event) { h.record("scheduled", e) }
+func (h *recordingHooks) OnFired(e Event)     { h.record("fired", e) }
+func (h *recordingHooks) OnSucceeded(e Event) { h.record("succeeded", e) }
+func (h *recordingHooks) OnFailed(e Event)    { h.record("failed", e) }
+func (h *recordingHooks) OnPanic(e Event)     { h.record("panic", e) }
+
+func TestTimeWheelHooks(t *testing.T) {
+	clock := NewFakeClock(time.Date(2023, 6, 14, 0, 0, 0, 0, time.UTC))
+	hooks, metrics := &recordingHooks{}, NewMetrics()
+	tw := NewTimeWheel(60, time.Second, WithClock(clock), WithHooks(hooks, metrics))
+	metrics.SetPending(func(context.Context) (int, error) { return tw.Len(), nil })
+	tw.Run()
+	defer tw.Stop()
+
+	executionTime := clock.Now().Add(time.Second)
+	handles := []*Handle{
+		tw.AddTask("ok", func() {}, executionTime),
+		tw.AddJob("error", func(context.Context) error { return errors.New("boom") }, executionTime),
+		tw.AddTask("panic", func() { panic("boom") }, executionTime),
+		tw.AddTask("later", func() {}, clock.Now().Add(time.Hour)),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clock.Advance(2 * time.Second)
+	for _, h := range handles[:3] {
+		_ = h.Wait(ctx)
+	}
+
+	for _, event := range []string{"scheduled later", "fired ok", "succeeded ok", "failed error", "panic panic"} {
+		if !hooks.has(event) {
+			t.Fatalf("got %v, expect %q", hooks.events, event)
+		}
+	}
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range []string{
+		"timewheel_tasks_scheduled_total 4",
+		"timewheel_tasks_fired_total 3",
+		`timewheel_tasks_finished_total{outcome="failed"} 1`,
+		`timewheel_tasks_finished_total{outcome="panicked"} 1`,
+		"timewheel_tasks_pending 1",
+		"timewheel_task_lateness_seconds_count 3",
+	} {
+		if !bytes.Contains(rec.Body.Bytes(), []byte(line+"\n")) {
+			t.Fatalf("got metrics\n%s\nexpect %q", rec.Body.String(), line)
+		}
+	}
+}
+
+func TestRTimeWheelHooks(t *testing.T) {
+	hooks := &recordingHooks{}
+	rtw := newTestRTimeWheel(t, WithHooks(hooks))
+	rtw.RegisterHandler("panic", func(ctx context.Context, task *RTask) error {
+		panic("boom")
+	})
+	rtw.Run()
+	defer rtw.Shutdown(context.Background())
+	ctx := context.Background()
+	key := fmt.Sprintf("hooks_%d", time.Now().UnixNano())
+
+	if err := rtw.AddTask(ctx, key, &RTask{Type: ExecutorFunc, Target: "panic"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	<-time.After(2500 * time.Millisecond)
+
+	for _, event := range []string{"scheduled", "fired", "panic"} {
+		if !hooks.has(event + " " + key) {
+			t.Fatalf("got %v, expect %s %s", hooks.events, event, key)
+		}
+	}
+	letter, err := rtw.GetDeadLetter(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(letter.LastError, "boom") {
+		t.Fatalf("got %+v, expect the panic dead-lettered", letter)
+	}
+}
+
+func TestRTimeWheelLeaseRenewal(t *testing.T) {
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls[r.URL.Query().Get("key")]++
+		mu.Unlock()
+		time.Sleep(1200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	// the last task waits for the host about thrice the lease
+	suffix := fmt.Sprintf("%d", time.Now().UnixNano())
+	rtw := newTestRTimeWheel(t, WithNamespace("renewal_"+suffix), WithLease(2*time.Second), WithMaxPerHost(1), WithMaxInFlight(3))
+	rtw.Run()
+	defer rtw.Shutdown(context.Background())
+	ctx := context.Background()
+	executionTime := time.Now().Add(time.Second)
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("renewal_%d_%s", i, suffix)
+		if err := rtw.AddTask(ctx, key, &RTask{
+			CallbackURL: server.URL,
+			Method:      http.MethodGet,
+			Query:       map[string]string{"key": key},
+		}, executionTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-time.After(1500 * time.Millisecond)
+	if n, err := rtw.Len(ctx); err != nil || n != 2 {
+		t.Fatalf("%d tasks pending, err %v, expect 2 left unclaimed beyond the free slots", n, err)
+	}
+	<-time.After(7 * time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(calls) != 5 {
+		t.Fatalf("got calls %v, expect every task called", calls)
+	}
+	for key, n := range calls {
+		if n != 1 {
+			t.Fatalf("task %s called %d times, expect once", key, n)
+		}
+	}
+}